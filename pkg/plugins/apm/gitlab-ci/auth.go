@@ -1,12 +1,253 @@
 package gitlab_ci
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// "Authorization: Bearer <token>", works with personal, group, project and OAuth access tokens
+	authModeBearer = "bearer"
+	// "PRIVATE-TOKEN: <token>", works with personal, group and project access tokens
+	authModePrivateToken = "private_token"
+	// "JOB-TOKEN: <token>", works with CI job tokens
+	authModeJobToken = "job_token"
+	// "Authorization: Bearer <token>", where the token is obtained and refreshed from an OAuth 2.0 token endpoint
+	authModeOAuth = "oauth"
+
+	// refresh OAuth access tokens a bit before they actually expire
+	oauthExpiryLeeway = 30 * time.Second
+)
+
+// tokenSource provides the credential sent with every request.
+type tokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// tokenInvalidator is implemented by token sources that can tell a token is rejected, so that a new one is obtained
+// for the next request.
+type tokenInvalidator interface {
+	Invalidate(token string)
+}
 
 type authenticatedHttpTransport struct {
-	authHeader string
+	header string
+	prefix string
+	tokens tokenSource
+	next   http.RoundTripper
 }
 
 func (t *authenticatedHttpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Add("Authorization", t.authHeader)
-	return http.DefaultTransport.RoundTrip(req)
+	token, err := t.tokens.Token(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(t.header, t.prefix+token)
+	resp, err := t.next.RoundTrip(req)
+
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		if i, ok := t.tokens.(tokenInvalidator); ok {
+			i.Invalidate(token)
+		}
+	}
+
+	return resp, err
+}
+
+// staticTokenSource is a token that never changes.
+type staticTokenSource string
+
+func (s staticTokenSource) Token(_ context.Context) (string, error) {
+	return string(s), nil
+}
+
+// fileTokenSource reads the token from a file, and reads it again whenever the file changes, so that tokens rotated
+// by e.g. Vault Agent are picked up without a restart.
+type fileTokenSource struct {
+	path string
+
+	lock    sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func (s *fileTokenSource) Token(_ context.Context) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if s.token != "" {
+			// the file might be in the middle of being replaced, keep using the previous token
+			return s.token, nil
+		}
+		return "", err
+	}
+
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size && s.token != "" {
+		return s.token, nil
+	}
+
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		if s.token != "" {
+			return s.token, nil
+		}
+		return "", fmt.Errorf("token file %s is empty", s.path)
+	}
+
+	s.token = token
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return s.token, nil
+}
+
+func (s *fileTokenSource) Invalidate(_ string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// force reading the file again
+	s.modTime = time.Time{}
+}
+
+// oauthTokenSource obtains access tokens from an OAuth 2.0 token endpoint, using the refresh token grant if a refresh
+// token is available, or the client credentials grant otherwise.
+type oauthTokenSource struct {
+	client       *http.Client
+	tokenUrl     string
+	clientId     string
+	clientSecret string
+	scopes       string
+
+	lock         sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiry       time.Time
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+func (s *oauthTokenSource) Token(ctx context.Context) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.accessToken != "" && (s.expiry.IsZero() || time.Now().Add(oauthExpiryLeeway).Before(s.expiry)) {
+		return s.accessToken, nil
+	}
+
+	form := neturl.Values{}
+	if s.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.refreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if s.scopes != "" {
+		form.Set("scope", s.scopes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(neturl.QueryEscape(s.clientId), neturl.QueryEscape(s.clientSecret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	t := &oauthTokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(t); err != nil {
+		return "", fmt.Errorf("unable to decode OAuth token response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || t.AccessToken == "" {
+		return "", fmt.Errorf("OAuth token request failed (%s): %s %s", resp.Status, t.Error, t.Description)
+	}
+
+	s.accessToken = t.AccessToken
+	if t.RefreshToken != "" {
+		// GitLab rotates refresh tokens, the previous one is no longer valid
+		s.refreshToken = t.RefreshToken
+	}
+	s.expiry = time.Time{}
+	if t.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Second * time.Duration(t.ExpiresIn))
+	}
+
+	return s.accessToken, nil
+}
+
+func (s *oauthTokenSource) Invalidate(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.accessToken == token {
+		s.accessToken = ""
+	}
+}
+
+// newAuthenticatedHttpTransport creates the transport that authenticates requests from the plugin config. next is used
+// for both the authenticated requests and the requests to the OAuth token endpoint.
+func newAuthenticatedHttpTransport(config map[string]string, next http.RoundTripper) (*authenticatedHttpTransport, error) {
+	t := &authenticatedHttpTransport{
+		header: "Authorization",
+		prefix: "Bearer ",
+		next:   next,
+	}
+
+	var tokens tokenSource = staticTokenSource(config["token"])
+	if config["token_file"] != "" {
+		tokens = &fileTokenSource{path: config["token_file"]}
+	}
+
+	switch config["auth_mode"] {
+	case authModeBearer:
+	case authModePrivateToken:
+		t.header = "PRIVATE-TOKEN"
+		t.prefix = ""
+	case authModeJobToken:
+		t.header = "JOB-TOKEN"
+		t.prefix = ""
+	case authModeOAuth:
+		if config["oauth_token_url"] == "" {
+			return nil, fmt.Errorf("oauth_token_url is required with auth_mode %s", authModeOAuth)
+		}
+		tokens = &oauthTokenSource{
+			client:       &http.Client{Transport: next},
+			tokenUrl:     config["oauth_token_url"],
+			clientId:     config["oauth_client_id"],
+			clientSecret: config["oauth_client_secret"],
+			scopes:       config["oauth_scopes"],
+			refreshToken: config["oauth_refresh_token"],
+		}
+	default:
+		return nil, fmt.Errorf("unsupported auth_mode %q, must be one of %v", config["auth_mode"], []string{authModeBearer, authModePrivateToken, authModeJobToken, authModeOAuth})
+	}
+
+	t.tokens = tokens
+	return t, nil
 }
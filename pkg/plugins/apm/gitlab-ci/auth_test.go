@@ -0,0 +1,226 @@
+package gitlab_ci
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileTokenSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	s := &fileTokenSource{path: path}
+
+	// missing file without a previous token
+	_, err := s.Token(context.Background())
+	assert.Error(t, err)
+
+	// empty file without a previous token
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0o600))
+	_, err = s.Token(context.Background())
+	assert.ErrorContains(t, err, "is empty")
+
+	require.NoError(t, os.WriteFile(path, []byte("token-1\n"), 0o600))
+	got, err := s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", got)
+
+	// reloaded on change
+	require.NoError(t, os.WriteFile(path, []byte("token-22\n"), 0o600))
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-22", got)
+
+	// the previous token is kept while the file is being replaced
+	require.NoError(t, os.Remove(path))
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-22", got)
+
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-22", got)
+
+	require.NoError(t, os.WriteFile(path, []byte("token-33\n"), 0o600))
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-33", got)
+
+	// a change keeping both the size and the modification time is only picked up after the token is rejected
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("token-44\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-33", got)
+
+	s.Invalidate(got)
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-44", got)
+}
+
+// fakeTokenEndpoint is an OAuth 2.0 token endpoint issuing numbered access tokens and rotating refresh tokens.
+type fakeTokenEndpoint struct {
+	server    *httptest.Server
+	expiresIn int64
+
+	lock     sync.Mutex
+	requests []map[string]string
+}
+
+func newFakeTokenEndpoint(t *testing.T) *fakeTokenEndpoint {
+	f := &fakeTokenEndpoint{expiresIn: 3600}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		id, secret, _ := r.BasicAuth()
+		if err := r.ParseForm(); err != nil || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(oauthTokenResponse{Error: "invalid_client"})
+			return
+		}
+
+		f.requests = append(f.requests, map[string]string{
+			"grant_type":    r.PostForm.Get("grant_type"),
+			"refresh_token": r.PostForm.Get("refresh_token"),
+			"scope":         r.PostForm.Get("scope"),
+		})
+		n := len(f.requests)
+
+		if r.PostForm.Get("grant_type") == "refresh_token" && r.PostForm.Get("refresh_token") != "refresh-"+strconv.Itoa(n-1) {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(oauthTokenResponse{Error: "invalid_grant", Description: "the refresh token is revoked"})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(oauthTokenResponse{
+			AccessToken:  "access-" + strconv.Itoa(n),
+			RefreshToken: "refresh-" + strconv.Itoa(n),
+			ExpiresIn:    f.expiresIn,
+		})
+	}))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeTokenEndpoint) source(refreshToken string) *oauthTokenSource {
+	return &oauthTokenSource{
+		client:       f.server.Client(),
+		tokenUrl:     f.server.URL,
+		clientId:     "client",
+		clientSecret: "secret",
+		scopes:       "read_api",
+		refreshToken: refreshToken,
+	}
+}
+
+func (f *fakeTokenEndpoint) grants() []map[string]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]map[string]string(nil), f.requests...)
+}
+
+func TestOAuthTokenSource(t *testing.T) {
+	f := newFakeTokenEndpoint(t)
+	s := f.source("refresh-0")
+
+	got, err := s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", got)
+
+	// cached until it expires
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", got)
+
+	// only the rejected token is dropped
+	s.Invalidate("access-0")
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", got)
+
+	// refreshed with the rotated refresh token
+	s.Invalidate("access-1")
+	got, err = s.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "access-2", got)
+
+	assert.Equal(t, []map[string]string{
+		{"grant_type": "refresh_token", "refresh_token": "refresh-0", "scope": "read_api"},
+		{"grant_type": "refresh_token", "refresh_token": "refresh-1", "scope": "read_api"},
+	}, f.grants())
+}
+
+func TestOAuthTokenSourceExpiry(t *testing.T) {
+	f := newFakeTokenEndpoint(t)
+	// expires within the leeway, so every call refreshes
+	f.expiresIn = int64(oauthExpiryLeeway/time.Second) - 1
+	s := f.source("")
+
+	for i := 1; i <= 3; i++ {
+		got, err := s.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "access-"+strconv.Itoa(i), got)
+	}
+
+	// the first grant is client credentials, then the issued refresh tokens are used
+	grants := f.grants()
+	require.Len(t, grants, 3)
+	assert.Equal(t, map[string]string{"grant_type": "client_credentials", "refresh_token": "", "scope": "read_api"}, grants[0])
+	assert.Equal(t, map[string]string{"grant_type": "refresh_token", "refresh_token": "refresh-1", "scope": "read_api"}, grants[1])
+	assert.Equal(t, map[string]string{"grant_type": "refresh_token", "refresh_token": "refresh-2", "scope": "read_api"}, grants[2])
+}
+
+func TestOAuthTokenSourceErrors(t *testing.T) {
+	f := newFakeTokenEndpoint(t)
+
+	// revoked refresh token
+	_, err := f.source("refresh-9").Token(context.Background())
+	assert.ErrorContains(t, err, "the refresh token is revoked")
+
+	s := f.source("")
+	s.clientSecret = "wrong"
+	_, err = s.Token(context.Background())
+	assert.ErrorContains(t, err, "invalid_client")
+}
+
+// TestTokenFileInvalidation checks that a token rejected by GitLab makes the token file read again.
+func TestTokenFileInvalidation(t *testing.T) {
+	fake := newFakeGitLab(t)
+	path := filepath.Join(t.TempDir(), "token")
+
+	// same size as the valid token
+	require.NoError(t, os.WriteFile(path, []byte("glpat-xxx"), 0o600))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	p := newTestPlugin(t, fake, map[string]string{
+		"token":      "",
+		"token_file": path,
+	})
+
+	_, err = p.Query(`metric:"pending"`, fixtureRange)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(token), 0o600))
+	require.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+
+	_, err = p.Query(`metric:"pending"`, fixtureRange)
+	require.NoError(t, err)
+}
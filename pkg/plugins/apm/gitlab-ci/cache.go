@@ -0,0 +1,90 @@
+package gitlab_ci
+
+import (
+	"github.com/hashicorp/go-hclog"
+	"sync"
+	"time"
+)
+
+// snapshot is a result fetched from GitLab that covers the time range starting at notBefore.
+type snapshot[T any] struct {
+	value     T
+	notBefore time.Time
+	fetchedAt time.Time
+}
+
+// inflightFetch is a fetch that is still running, which other callers can wait for.
+type inflightFetch[T any] struct {
+	done      chan struct{}
+	notBefore time.Time
+	value     T
+	err       error
+}
+
+// snapshotCache shares results fetched from GitLab between concurrent and subsequent queries. A cached snapshot is
+// reused if it is younger than ttl, and covers the requested time range; concurrent callers of the same key share a
+// single in-flight fetch. If a fetch fails, a snapshot younger than maxStale is served instead of the error.
+type snapshotCache[T any] struct {
+	logger   hclog.Logger
+	ttl      time.Duration
+	maxStale time.Duration
+
+	lock     sync.Mutex
+	entries  map[string]*snapshot[T]
+	inflight map[string]*inflightFetch[T]
+}
+
+func newSnapshotCache[T any](logger hclog.Logger, ttl time.Duration, maxStale time.Duration) *snapshotCache[T] {
+	return &snapshotCache[T]{
+		logger:   logger,
+		ttl:      ttl,
+		maxStale: maxStale,
+		entries:  make(map[string]*snapshot[T]),
+		inflight: make(map[string]*inflightFetch[T]),
+	}
+}
+
+// get returns the snapshot of key covering the time range starting at notBefore, calling fetch only if there is no
+// usable cached snapshot or in-flight fetch. The value returned is shared and must not be modified.
+func (c *snapshotCache[T]) get(key string, notBefore time.Time, fetch func() (T, error)) (T, bool, error) {
+	c.lock.Lock()
+
+	if e, ok := c.entries[key]; ok && time.Since(e.fetchedAt) < c.ttl && !notBefore.Before(e.notBefore) {
+		c.lock.Unlock()
+		return e.value, true, nil
+	}
+
+	if f, ok := c.inflight[key]; ok && !notBefore.Before(f.notBefore) {
+		c.lock.Unlock()
+		<-f.done
+		return f.value, true, f.err
+	}
+
+	f := &inflightFetch[T]{
+		done:      make(chan struct{}),
+		notBefore: notBefore,
+	}
+	c.inflight[key] = f
+	c.lock.Unlock()
+
+	f.value, f.err = fetch()
+
+	c.lock.Lock()
+	if e, ok := c.entries[key]; ok && f.err != nil && time.Since(e.fetchedAt) < c.maxStale && !notBefore.Before(e.notBefore) {
+		c.logger.Warn("fetch failed, serving stale snapshot", "key", key, "age", time.Since(e.fetchedAt), "error", f.err)
+		f.value, f.err = e.value, nil
+	} else if f.err == nil && (c.ttl > 0 || c.maxStale > 0) {
+		c.entries[key] = &snapshot[T]{
+			value:     f.value,
+			notBefore: notBefore,
+			fetchedAt: time.Now(),
+		}
+	}
+	if c.inflight[key] == f {
+		delete(c.inflight, key)
+	}
+	c.lock.Unlock()
+	close(f.done)
+
+	return f.value, false, f.err
+}
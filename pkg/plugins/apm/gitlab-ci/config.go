@@ -0,0 +1,123 @@
+package gitlab_ci
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// nomad-autoscaler adds the agent's Nomad config to every plugin's config as "nomad_*" keys
+	nomadConfigPrefix = "nomad_"
+	// masked in logs
+	configKeyNomadToken    = "nomad_token"
+	configKeyNomadHttpAuth = "nomad_http-auth"
+)
+
+var (
+	// masked in logs, including the named instances' ones
+	secretConfigKeys = []string{"token", "oauth_client_secret", "oauth_refresh_token", "webhook_secret", configKeyNomadToken, configKeyNomadHttpAuth}
+)
+
+// configParser parses config values, and collects every error instead of stopping at the first one, so that all the
+// invalid keys are reported at once.
+type configParser struct {
+	config map[string]string
+	// prepended to the keys in errors, for named instances
+	prefix string
+	errs   []error
+}
+
+func (p *configParser) errorf(key string, format string, args ...any) {
+	p.errs = append(p.errs, fmt.Errorf("%s%s: %s", p.prefix, key, fmt.Sprintf(format, args...)))
+}
+
+// err returns all the errors collected, or nil if there is none.
+func (p *configParser) err() error {
+	return errors.Join(p.errs...)
+}
+
+func (p *configParser) positiveInt(key string) int {
+	l, err := strconv.ParseInt(p.config[key], 10, 64)
+	if err != nil || l <= 0 {
+		p.errorf(key, "must be a positive integer, got %q instead", p.config[key])
+	}
+	return int(l)
+}
+
+func (p *configParser) nonNegativeInt(key string) int {
+	l, err := strconv.ParseInt(p.config[key], 10, 64)
+	if err != nil || l < 0 {
+		p.errorf(key, "must be a non-negative integer, got %q instead", p.config[key])
+	}
+	return int(l)
+}
+
+func (p *configParser) positiveSeconds(key string) time.Duration {
+	return time.Second * time.Duration(p.positiveInt(key))
+}
+
+func (p *configParser) nonNegativeSeconds(key string) time.Duration {
+	return time.Second * time.Duration(p.nonNegativeInt(key))
+}
+
+func (p *configParser) nonNegativeMilliseconds(key string) time.Duration {
+	return time.Millisecond * time.Duration(p.nonNegativeInt(key))
+}
+
+func (p *configParser) bool(key string) bool {
+	b, err := strconv.ParseBool(p.config[key])
+	if err != nil {
+		p.errorf(key, "must be a boolean, got %q instead", p.config[key])
+	}
+	return b
+}
+
+// fraction parses a number in [0, 1].
+func (p *configParser) fraction(key string) float64 {
+	f, err := strconv.ParseFloat(p.config[key], 64)
+	if err != nil || math.IsNaN(f) || f < 0 || f > 1 {
+		p.errorf(key, "must be a number in [0, 1], got %q instead", p.config[key])
+	}
+	return f
+}
+
+func (p *configParser) oneOf(key string, values []string) string {
+	if !slices.Contains(values, p.config[key]) {
+		p.errorf(key, "must be one of %v, got %q instead", values, p.config[key])
+	}
+	return p.config[key]
+}
+
+// maskConfig returns a copy of the config that is safe to log, with the secrets replaced by asterisks.
+func maskConfig(config map[string]string) map[string]string {
+	ret := make(map[string]string, len(config))
+	for k, v := range config {
+		if slices.Contains(secretConfigKeys, k[strings.LastIndex(k, ".")+1:]) {
+			v = strings.Repeat("*", len(v))
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
+// unknownKeys reports the keys in the user config that are neither known nor set by nomad-autoscaler itself.
+// Named instances' keys are checked by instanceConfigs.
+func (p *configParser) unknownKeys(config map[string]string) {
+	var keys []string
+	for k := range config {
+		if _, ok := defaultConfig[k]; ok || strings.HasPrefix(k, nomadConfigPrefix) || strings.HasPrefix(k, instanceConfigPrefix) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+	for _, k := range keys {
+		p.errorf(k, "unknown config key")
+	}
+}
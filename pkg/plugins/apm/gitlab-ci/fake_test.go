@@ -0,0 +1,284 @@
+package gitlab_ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFailure is a response returned instead of the real one, for error injection.
+type fakeFailure struct {
+	// HTTP status code; 200 returns a GraphQL error
+	status  int
+	message string
+	// response headers, e.g. Retry-After
+	header http.Header
+}
+
+var (
+	fakeVariableDeclaration = regexp.MustCompile(`\$(\w+):\s*([\w!\[\]]+)`)
+
+	// the variable types of the operations used by the plugin, as GitLab's schema expects them
+	fakeVariableTypes = map[string]map[string]string{
+		"getAllJobs":       {"after": "String", "first": "Int", "statuses": "[CiJobStatus!]!"},
+		"getProjectJobs":   {"after": "String", "first": "Int", "fullPath": "ID!", "statuses": "[CiJobStatus!]!"},
+		"getGroupProjects": {"after": "String", "first": "Int", "fullPath": "ID!"},
+		"getAllRunners":    {"after": "String", "first": "Int"},
+		"getGroupRunners":  {"after": "String", "first": "Int", "fullPath": "ID!"},
+		"getProjectJob":    {"fullPath": "ID!", "id": "JobID!"},
+	}
+)
+
+// fakeGitLab is a GitLab GraphQL API serving the job and runner fixtures in testdata, which implements just enough of
+// the API for the operations used by the plugin.
+type fakeGitLab struct {
+	t      *testing.T
+	server *httptest.Server
+
+	jobs    []map[string]any
+	runners []map[string]any
+
+	lock sync.Mutex
+	// caps the page size requested, like GitLab does at 100
+	pageSize int
+	// returned in order before serving any real response
+	failures []fakeFailure
+	// requests received by operation name
+	requests map[string]int
+	// how long every response takes
+	delay time.Duration
+}
+
+func newFakeGitLab(t *testing.T) *fakeGitLab {
+	f := &fakeGitLab{
+		t:        t,
+		pageSize: maxPageSize,
+		requests: make(map[string]int),
+	}
+	f.jobs = loadFixture(t, "testdata/jobs.json")
+	f.runners = loadFixture(t, "testdata/runners.json")
+
+	// GitLab lists jobs newest first
+	slices.SortStableFunc(f.jobs, func(a, b map[string]any) int {
+		return strings.Compare(b["createdAt"].(string), a["createdAt"].(string))
+	})
+
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func loadFixture(t *testing.T, path string) []map[string]any {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read fixture %s: %v", path, err)
+	}
+
+	var ret []map[string]any
+	if err := json.Unmarshal(content, &ret); err != nil {
+		t.Fatalf("unable to parse fixture %s: %v", path, err)
+	}
+	return ret
+}
+
+// fail injects failures returned by the next requests.
+func (f *fakeGitLab) fail(failures ...fakeFailure) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.failures = append(f.failures, failures...)
+}
+
+// requestCount returns how many requests of the operation have been received, including failed ones.
+func (f *fakeGitLab) requestCount(operation string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.requests[operation]
+}
+
+func (f *fakeGitLab) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer "+token {
+		http.Error(rw, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.lock.Lock()
+	f.requests[body.OperationName]++
+	var failure *fakeFailure
+	if len(f.failures) > 0 {
+		failure = &f.failures[0]
+		f.failures = f.failures[1:]
+	}
+	pageSize := f.pageSize
+	delay := f.delay
+	f.lock.Unlock()
+	time.Sleep(delay)
+
+	if failure != nil {
+		for k, v := range failure.header {
+			rw.Header()[k] = v
+		}
+		if failure.status != http.StatusOK {
+			http.Error(rw, failure.message, failure.status)
+			return
+		}
+		f.respond(rw, map[string]any{"errors": []any{map[string]any{"message": failure.message}}})
+		return
+	}
+
+	if err := checkVariableTypes(body.OperationName, body.Query); err != "" {
+		f.t.Errorf("%s: %s", body.OperationName, err)
+		f.respond(rw, map[string]any{"errors": []any{map[string]any{"message": err}}})
+		return
+	}
+
+	fullPath, _ := body.Variables["fullPath"].(string)
+	var data map[string]any
+	switch body.OperationName {
+	case "getAllJobs":
+		data = map[string]any{"jobs": f.page(f.filterJobs("", body.Variables), body.Variables, pageSize)}
+	case "getProjectJobs":
+		// GitLab returns null for unknown projects
+		data = map[string]any{"project": nil}
+		if len(f.groupProjects(fullPath, true)) > 0 {
+			data["project"] = map[string]any{"jobs": f.page(f.filterJobs(fullPath, body.Variables), body.Variables, pageSize)}
+		}
+	case "getGroupProjects":
+		data = map[string]any{"group": nil}
+		if projects := f.groupProjects(fullPath, false); len(projects) > 0 {
+			data["group"] = map[string]any{"projects": f.page(projects, body.Variables, pageSize)}
+		}
+	case "getProjectJob":
+		data = map[string]any{"project": nil}
+		if len(f.groupProjects(fullPath, true)) > 0 {
+			data["project"] = map[string]any{"job": f.job(body.Variables["id"])}
+		}
+	case "getAllRunners":
+		data = map[string]any{"runners": f.page(f.runners, body.Variables, pageSize)}
+	case "getGroupRunners":
+		data = map[string]any{"group": nil}
+		if len(f.groupProjects(fullPath, false)) > 0 {
+			data["group"] = map[string]any{"runners": f.page(f.runners, body.Variables, pageSize)}
+		}
+	default:
+		f.t.Errorf("unexpected operation %q", body.OperationName)
+		http.Error(rw, "unexpected operation", http.StatusBadRequest)
+		return
+	}
+
+	f.respond(rw, map[string]any{"data": data})
+}
+
+// checkVariableTypes validates the variables declared by the query against the argument types in GitLab's schema, like
+// GitLab does before running it, and returns the validation error if any.
+func checkVariableTypes(operation string, query string) string {
+	header, _, _ := strings.Cut(query, "{")
+	for _, m := range fakeVariableDeclaration.FindAllStringSubmatch(header, -1) {
+		want, ok := fakeVariableTypes[operation][m[1]]
+		if !ok {
+			return fmt.Sprintf("variable $%s is never used", m[1])
+		}
+		if m[2] != want {
+			return fmt.Sprintf("variable $%s of type %s is used in a position expecting %s", m[1], m[2], want)
+		}
+	}
+	return ""
+}
+
+func (f *fakeGitLab) respond(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		f.t.Errorf("unable to encode response: %v", err)
+	}
+}
+
+// groupProjects returns the projects of the jobs in the group, or the project itself if exact is set.
+func (f *fakeGitLab) groupProjects(fullPath string, exact bool) []map[string]any {
+	var ret []map[string]any
+	for _, j := range f.jobs {
+		p := j["project"].(map[string]any)
+		match := strings.HasPrefix(p["fullPath"].(string), fullPath+"/")
+		if exact {
+			match = p["fullPath"] == fullPath
+		}
+		if match && !slices.ContainsFunc(ret, func(e map[string]any) bool {
+			return e["fullPath"] == p["fullPath"]
+		}) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// job returns the job with the ID, or nil if there is none.
+func (f *fakeGitLab) job(id any) map[string]any {
+	for _, j := range f.jobs {
+		if j["id"] == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// filterJobs returns the jobs of the project (or all the jobs if project is empty) in the requested statuses.
+func (f *fakeGitLab) filterJobs(project string, variables map[string]any) []map[string]any {
+	statuses, _ := variables["statuses"].([]any)
+
+	var ret []map[string]any
+	for _, j := range f.jobs {
+		if project != "" && j["project"].(map[string]any)["fullPath"] != project {
+			continue
+		}
+		if len(statuses) > 0 && !slices.Contains(statuses, j["status"]) {
+			continue
+		}
+		ret = append(ret, j)
+	}
+	return ret
+}
+
+// page returns a connection of the nodes requested by the first and after variables. Cursors are node offsets.
+func (f *fakeGitLab) page(nodes []map[string]any, variables map[string]any, pageSize int) map[string]any {
+	start := 0
+	if after, ok := variables["after"].(string); ok {
+		offset, err := strconv.Atoi(after)
+		if err != nil {
+			f.t.Errorf("invalid cursor %q", after)
+		}
+		start = offset
+	}
+
+	end := len(nodes)
+	if first, ok := variables["first"].(float64); ok {
+		end = min(end, start+min(int(first), pageSize))
+	}
+	start = min(start, end)
+
+	return map[string]any{
+		"nodes": append([]map[string]any{}, nodes[start:end]...),
+		"pageInfo": map[string]any{
+			"endCursor":   strconv.Itoa(end),
+			"hasNextPage": end < len(nodes),
+		},
+	}
+}
@@ -2,40 +2,256 @@ package gitlab_ci
 
 import (
 	"context"
+	"fmt"
 	"github.com/hasura/go-graphql-client"
+	"slices"
 	"time"
 )
 
+const (
+	// GitLab refuses to return more than 100 nodes per page
+	maxPageSize = 100
+)
+
 type CiJobStatus string
 
 func (_ CiJobStatus) GetGraphQLType() string { return "CiJobStatus" }
 
+type pageInfo struct {
+	EndCursor   string `graphql:"endCursor"`
+	HasNextPage bool   `graphql:"hasNextPage"`
+}
+
+type jobNode struct {
+	ID         string    `graphql:"id"`
+	Status     string    `graphql:"status"`
+	CreatedAt  time.Time `graphql:"createdAt"`
+	QueuedAt   time.Time `graphql:"queuedAt"`
+	StartedAt  time.Time `graphql:"startedAt"`
+	FinishedAt time.Time `graphql:"finishedAt"`
+	Duration   uint      `graphql:"duration"`
+	Active     bool      `graphql:"active"`
+	Stuck      bool      `graphql:"stuck"`
+	Tags       []string  `graphql:"tags"`
+	Name       string    `graphql:"name"`
+	RefName    string    `graphql:"refName"`
+	Stage      struct {
+		Name string `graphql:"name"`
+	} `graphql:"stage"`
+	Pipeline struct {
+		Source string `graphql:"source"`
+	} `graphql:"pipeline"`
+	Project struct {
+		FullPath string `graphql:"fullPath"`
+	} `graphql:"project"`
+	Runner struct {
+		ID string `graphql:"id"`
+	} `graphql:"runner"`
+}
+
+type jobConnection struct {
+	Nodes    []jobNode `graphql:"nodes"`
+	PageInfo pageInfo  `graphql:"pageInfo"`
+}
+
 type queryGetAllJobs struct {
-	Jobs struct {
-		Nodes []struct {
-			Status     string    `graphql:"status"`
-			CreatedAt  time.Time `graphql:"createdAt"`
-			FinishedAt time.Time `graphql:"finishedAt"`
-			Duration   uint      `graphql:"duration"`
-			Active     bool      `graphql:"active"`
-			Stuck      bool      `graphql:"stuck"`
-			Tags       []string  `graphql:"tags"`
-		} `graphql:"nodes"`
-	} `graphql:"jobs(first: $first, statuses: $statuses)"`
-}
-
-func (n *APMPlugin) listJobs(ctx context.Context, limit int) (*queryGetAllJobs, error) {
-	jobs := &queryGetAllJobs{}
-
-	err := n.gqlClient.Query(ctx, jobs, map[string]interface{}{
-		"first": &limit,
-		// we need every jobs that runs or can be run
-		"statuses": []CiJobStatus{"PREPARING", "PENDING", "RUNNING", "SUCCESS", "FAILED", "CANCELED"},
-	}, graphql.OperationName("getAllJobs"))
-
-	if err != nil {
-		return nil, err
+	Jobs jobConnection `graphql:"jobs(first: $first, after: $after, statuses: $statuses)"`
+}
+
+// GitLab returns null for a project or a group that does not exist or that the token cannot access, so they are
+// pointers to tell that apart from an empty one.
+type queryGetProjectJobs struct {
+	Project *struct {
+		Jobs jobConnection `graphql:"jobs(first: $first, after: $after, statuses: $statuses)"`
+	} `graphql:"project(fullPath: $fullPath)"`
+}
+
+type queryGetGroupProjects struct {
+	Group *struct {
+		Projects struct {
+			Nodes []struct {
+				FullPath string `graphql:"fullPath"`
+			} `graphql:"nodes"`
+			PageInfo pageInfo `graphql:"pageInfo"`
+		} `graphql:"projects(first: $first, after: $after, includeSubgroups: true)"`
+	} `graphql:"group(fullPath: $fullPath)"`
+}
+
+// notFoundError is returned for a null project or group; an empty result would otherwise read as zero demand.
+func notFoundError(kind string, path string) error {
+	return fmt.Errorf("%s %s is not found, or the token has no access to it", kind, path)
+}
+
+// jobScope decides where the jobs are listed from. If neither project nor group is set, the instance-wide job list is
+// used, which requires an administrator token.
+type jobScope struct {
+	project string
+	group   string
+}
+
+// String returns a key that identifies the scope.
+func (s jobScope) String() string {
+	switch {
+	case s.project != "":
+		return "project:" + s.project
+	case s.group != "":
+		return "group:" + s.group
+	default:
+		return "instance"
+	}
+}
+
+var (
+	// jobs that are not finished yet are always relevant, no matter when they are created
+	activeJobStatuses = []CiJobStatus{"PREPARING", "PENDING", "RUNNING"}
+	// finished jobs are only relevant if they overlap with the queried time range
+	finishedJobStatuses = []CiJobStatus{"SUCCESS", "FAILED", "CANCELED"}
+	// jobs in later pipeline stages, or waiting for a resource group; only listed for forecasting
+	upcomingJobStatuses = []CiJobStatus{"CREATED", "WAITING_FOR_RESOURCE"}
+)
+
+// listedJobStatus tells whether jobs in the status are ever listed; the others (e.g. manual, scheduled or skipped jobs)
+// are never counted.
+func listedJobStatus(status CiJobStatus) bool {
+	return slices.Contains(activeJobStatuses, status) || slices.Contains(finishedJobStatuses, status) || slices.Contains(upcomingJobStatuses, status)
+}
+
+// listJobs lists every job in the scope that runs or can be run in the time range starting at notBefore, at most limit
+// jobs. Upcoming jobs are only listed if upcoming is set.
+//
+// GitLab's job connections do not accept any time range arguments, so the time window is enforced by splitting the
+// request by job status: active jobs are listed regardless of their age, while finished jobs are listed newest first
+// until the oldest one fetched is created before notBefore minus finishedJobLookback, so that the jobs created before
+// the time range but finished inside it are listed too.
+func (g *gitlabInstance) listJobs(ctx context.Context, scope jobScope, limit int, notBefore time.Time, upcoming bool) ([]jobNode, error) {
+	var projects []string
+	if scope.group != "" {
+		var err error
+		projects, err = g.listGroupProjects(ctx, scope.group)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// an empty project means instance-wide
+		projects = []string{scope.project}
+	}
+
+	type listPass struct {
+		statuses  []CiJobStatus
+		notBefore time.Time
+	}
+	passes := []listPass{{statuses: activeJobStatuses}}
+	if upcoming {
+		passes = append(passes, listPass{statuses: upcomingJobStatuses})
+	}
+	passes = append(passes, listPass{statuses: finishedJobStatuses, notBefore: notBefore.Add(-g.finishedJobLookback)})
+
+	var ret []jobNode
+	for _, pass := range passes {
+		for _, project := range projects {
+			if len(ret) >= limit {
+				g.logger.Warn("query_job_limit reached, some jobs are not listed", "limit", limit, "statuses", pass.statuses, "project", project)
+				return ret, nil
+			}
+
+			jobs, err := g.listJobsByStatus(ctx, project, pass.statuses, limit-len(ret), pass.notBefore)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, jobs...)
+		}
+	}
+
+	return ret, nil
+}
+
+// listJobsByStatus pages through the job list of a project (or the whole instance if project is empty), newest first,
+// until either limit jobs have been fetched, or the oldest job fetched is created before notBefore.
+func (g *gitlabInstance) listJobsByStatus(ctx context.Context, project string, statuses []CiJobStatus, limit int, notBefore time.Time) ([]jobNode, error) {
+	var ret []jobNode
+	var after *string
+
+	for len(ret) < limit {
+		first := min(limit-len(ret), maxPageSize)
+		variables := map[string]interface{}{
+			"first":    &first,
+			"after":    after,
+			"statuses": statuses,
+		}
+
+		var jobs *jobConnection
+		if project == "" {
+			q := &queryGetAllJobs{}
+			if err := g.query(ctx, "getAllJobs", q, variables); err != nil {
+				return nil, err
+			}
+			jobs = &q.Jobs
+		} else {
+			q := &queryGetProjectJobs{}
+			variables["fullPath"] = graphql.ID(project)
+			if err := g.query(ctx, "getProjectJobs", q, variables); err != nil {
+				return nil, err
+			}
+			if q.Project == nil {
+				return nil, notFoundError("project", project)
+			}
+			jobs = &q.Project.Jobs
+		}
+
+		ret = append(ret, jobs.Nodes...)
+		for _, j := range jobs.Nodes {
+			g.metrics.add(selfMetricJobsFetched, 1, selfMetricLabelInstance, g.name, "status", j.Status)
+		}
+		g.logger.Trace("job page received", "project", project, "statuses", statuses, "count", len(jobs.Nodes), "total", len(ret), "has_next_page", jobs.PageInfo.HasNextPage)
+
+		if !jobs.PageInfo.HasNextPage || len(jobs.Nodes) == 0 {
+			break
+		}
+
+		// the requested time range is fully covered
+		if jobs.Nodes[len(jobs.Nodes)-1].CreatedAt.Before(notBefore) {
+			break
+		}
+
+		cursor := jobs.PageInfo.EndCursor
+		after = &cursor
+	}
+
+	return ret, nil
+}
+
+// listGroupProjects lists the full paths of every project in a group, including its subgroups.
+func (g *gitlabInstance) listGroupProjects(ctx context.Context, group string) ([]string, error) {
+	var ret []string
+	var after *string
+
+	for {
+		first := maxPageSize
+		q := &queryGetGroupProjects{}
+		err := g.query(ctx, "getGroupProjects", q, map[string]interface{}{
+			"first":    &first,
+			"after":    after,
+			"fullPath": graphql.ID(group),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if q.Group == nil {
+			return nil, notFoundError("group", group)
+		}
+
+		for _, p := range q.Group.Projects.Nodes {
+			ret = append(ret, p.FullPath)
+		}
+		g.logger.Trace("project page received", "group", group, "count", len(q.Group.Projects.Nodes), "total", len(ret))
+
+		if !q.Group.Projects.PageInfo.HasNextPage || len(q.Group.Projects.Nodes) == 0 {
+			break
+		}
+
+		cursor := q.Group.Projects.PageInfo.EndCursor
+		after = &cursor
 	}
 
-	return jobs, nil
+	return ret, nil
 }
@@ -1,36 +1,627 @@
 package gitlab_ci
 
 import (
+	"context"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-autoscaler/sdk"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 const (
-	url   = "https://gitlab.com/api/graphql"
 	token = "glpat-***"
 	tags  = ""
 )
 
+var (
+	// the time range covered by the fixtures in testdata
+	fixtureRange = sdk.TimeRange{
+		From: time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+		To:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+)
+
+// newTestPlugin creates a plugin talking to the fake GitLab.
+func newTestPlugin(t *testing.T, fake *fakeGitLab, config map[string]string) *APMPlugin {
+	c := map[string]string{
+		"graphql_endpoint":     fake.server.URL,
+		"token":                token,
+		"tags":                 tags,
+		"retry_min_backoff_ms": "1",
+		"retry_max_backoff_ms": "1",
+	}
+	maps.Copy(c, config)
+
+	plugin := NewGitLabPlugin(hclog.NewNullLogger()).(*APMPlugin)
+	require.NoError(t, plugin.SetConfig(c))
+	return plugin
+}
+
+// valueAt returns the value sampled at the time.
+func valueAt(t *testing.T, m sdk.TimestampedMetrics, at time.Time) float64 {
+	for _, p := range m {
+		if p.Timestamp.Equal(at) {
+			return p.Value
+		}
+	}
+
+	t.Fatalf("no sample at %s", at)
+	return 0
+}
+
 func TestQuery(t *testing.T) {
-	plugin := NewGitLabPlugin(hclog.Default())
+	fake := newFakeGitLab(t)
+	plugin := newTestPlugin(t, fake, nil)
 
-	// initialize
-	err := plugin.SetConfig(map[string]string{
-		"graphql_endpoint": url,
-		"token":            token,
-		"tags":             tags,
-	})
+	result, err := plugin.Query("", fixtureRange)
 	assert.NoError(t, err)
+	assert.NotNil(t, result)
+	assert.Len(t, result, 61)
+	assert.Equal(t, fixtureRange.From, result[0].Timestamp)
+	assert.Equal(t, fixtureRange.To, result[len(result)-1].Timestamp)
+
+	// jobs 4, 5, 6 and 8
+	assert.Equal(t, 4.0, valueAt(t, result, fixtureRange.To))
+}
+
+func TestJobStateAt(t *testing.T) {
+	at := func(minute int) time.Time {
+		return fixtureRange.From.Add(time.Duration(minute) * time.Minute)
+	}
+
+	finished := jobNode{Status: "SUCCESS", CreatedAt: at(0), StartedAt: at(10), FinishedAt: at(20)}
+	canceled := jobNode{Status: "CANCELED", CreatedAt: at(0), QueuedAt: at(0), FinishedAt: at(20)}
+	// no queuedAt, as if canceled while created, or on older GitLab versions
+	canceledUnqueued := jobNode{Status: "CANCELED", CreatedAt: at(0), FinishedAt: at(20)}
+	running := jobNode{Status: "RUNNING", CreatedAt: at(0), StartedAt: at(10)}
+	pending := jobNode{Status: "PENDING", CreatedAt: at(0)}
+	// no startedAt, as on very old GitLab versions
+	legacy := jobNode{Status: "SUCCESS", CreatedAt: at(0), FinishedAt: at(20), Duration: 600}
+	legacyRunning := jobNode{Status: "RUNNING", CreatedAt: at(0)}
+
+	cases := []struct {
+		name string
+		job  jobNode
+		at   time.Time
+		want jobState
+	}{
+		{"before creation", finished, at(-1), jobStateNone},
+		{"at creation", finished, at(0), jobStatePending},
+		{"before start", finished, at(9), jobStatePending},
+		{"at start", finished, at(10), jobStateRunning},
+		{"before finish", finished, at(19), jobStateRunning},
+		{"at finish", finished, at(20), jobStateNone},
+		{"canceled while pending", canceled, at(19), jobStatePending},
+		{"canceled", canceled, at(20), jobStateNone},
+		{"canceled while created", canceledUnqueued, at(19), jobStateUpcoming},
+		{"canceled without queuedAt", canceledUnqueued, at(20), jobStateNone},
+		{"still running", running, at(60), jobStateRunning},
+		{"still pending", pending, at(60), jobStatePending},
+		{"started from duration", legacy, at(9), jobStatePending},
+		{"running from duration", legacy, at(10), jobStateRunning},
+		{"running without startedAt", legacyRunning, at(0), jobStateRunning},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, c.job.stateAt(c.at))
+		})
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	fake := newFakeGitLab(t)
+	plugin := newTestPlugin(t, fake, nil)
+
+	at := func(minute int) time.Time {
+		return fixtureRange.From.Add(time.Duration(minute) * time.Minute)
+	}
+
+	priorities := map[string]string{
+		"priority_rules":   "source:merge_request_event=interactive, source:schedule=batch, source:push&ref:main=interactive",
+		"priority_weights": "batch=0.25",
+		"weights":          "tag:gpu=2",
+	}
+
+	cases := []struct {
+		name  string
+		query string
+		at    time.Time
+		want  float64
+		// plugin config, if not the default one
+		config map[string]string
+	}{
+		{"total", ``, at(58), 4, nil},
+		{"pending", `metric:"pending"`, at(58), 3, nil},
+		{"running", `metric:"running"`, at(58), 1, nil},
+		{"pending at creation", `metric:"pending"`, at(5), 1, nil},
+		{"running at start", `metric:"running"`, at(20), 1, nil},
+		{"canceled while pending", `metric:"pending"`, at(19), 2, nil},
+		{"queued", `metric:"pending"`, at(20), 2, nil},
+		{"stuck", `metric:"stuck"`, at(58), 1, nil},
+		{"exclude stuck", `metric:"pending" exclude_stuck:"true"`, at(58), 2, nil},
+		{"max pending age", `metric:"pending" max_pending_age_secs:"300"`, at(58), 1, nil},
+		{"tag", `tags:"linux"`, at(58), 3, nil},
+		{"tag and", `tags:"linux+gpu"`, at(58), 1, nil},
+		{"tag or", `tags:"gpu, windows"`, at(58), 2, nil},
+		{"tag exclusion", `tags:"-gpu"`, at(58), 3, nil},
+		{"tag glob", `tags:"win*"`, at(58), 1, nil},
+		{"tag regexp", `tags:"/^(gpu|windows)$/"`, at(58), 2, nil},
+		{"unknown tag", `tags:"macos"`, at(58), 0, nil},
+		{"project", `projects:"group/docs"`, at(58), 1, nil},
+		{"source", `sources:"schedule"`, at(58), 1, nil},
+		{"name", `names:"train"`, at(58), 1, nil},
+		{"ref", `refs:"feature/*"`, at(20), 1, nil},
+		{"stage", `stages:"deploy"`, at(58), 2, nil},
+		{"project scope", `project:"group/app"`, at(58), 3, nil},
+		{"group scope", `group:"group"`, at(58), 4, nil},
+		{"group runners", `metric:"runners_online" group:"group"`, at(58), 3, nil},
+		{"grouped", `group_by:"tag" group_aggregation:"max"`, at(58), 3, nil},
+		{"grouped without jobs", `group_by:"tag" group_aggregation:"max" tags:"macos"`, at(58), 0, nil},
+		{"runners", `metric:"runners_online" tags:"gpu"`, at(58), 1, nil},
+		{"max aggregation", `metric:"pending" aggregation:"max"`, at(20), 2, nil},
+		{"avg aggregation", `metric:"running" aggregation:"avg"`, at(50), 1, nil},
+		{"integral aggregation", `metric:"running" aggregation:"integral"`, at(50), 60, nil},
+		{"upcoming", `metric:"upcoming"`, at(58), 1, nil},
+		{"upcoming before queued", `metric:"upcoming"`, at(10), 1, nil},
+		{"wait max", `metric:"wait_max"`, at(20), 1140, nil},
+		{"wait avg", `metric:"wait_avg"`, at(20), 780, nil},
+		{"forecast", `metric:"forecast"`, at(58), 4.5, nil},
+		{"forecast discount", `metric:"forecast" forecast_discount:"1"`, at(58), 5, nil},
+		{"weights", `weights:"tag:gpu=2, name:pages=0.5, *=0.25"`, at(58), 3, nil},
+		{"unmatched weight", `weights:"tag:gpu=2"`, at(58), 5, nil},
+		{"priority weighted", ``, at(58), 4.25, priorities},
+		{"high priority only", `priorities:"interactive"`, at(58), 4, priorities},
+		{"low priority only", `priorities:"batch"`, at(58), 0.25, priorities},
+		{"unclassified priority", `priorities:"default"`, at(58), 0, priorities},
+		{"merge request with gpu", `metric:"running" priorities:"interactive"`, at(20), 2, priorities},
+		{"grouped by priority", `group_by:"priority" group_aggregation:"max"`, at(58), 4, priorities},
+		{"query weights over priorities", `weights:"*=1"`, at(58), 3.25, priorities},
+		{"runners with priorities", `metric:"runners_online"`, at(58), 3, priorities},
+	}
 
-	now := time.Now()
-	result, err := plugin.Query("", sdk.TimeRange{
-		From: now.Add(-60 * time.Minute),
-		To:   now,
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := plugin
+			if c.config != nil {
+				p = newTestPlugin(t, fake, c.config)
+			}
+
+			result, err := p.Query(c.query, fixtureRange)
+			require.NoError(t, err)
+			assert.Equal(t, c.want, valueAt(t, result, c.at))
+		})
+	}
+}
+
+func TestSampleAlign(t *testing.T) {
+	fake := newFakeGitLab(t)
+
+	for _, interval := range []int64{7, 60, 5 * 3600} {
+		t.Run(strconv.FormatInt(interval, 10), func(t *testing.T) {
+			plugin := newTestPlugin(t, fake, map[string]string{"sample_interval_secs": strconv.FormatInt(interval, 10)})
+			r := sdk.TimeRange{From: fixtureRange.From.Add(time.Second), To: fixtureRange.To.Add(10 * time.Hour)}
+
+			result, err := plugin.Query(`sample_align:"true"`, r)
+			require.NoError(t, err)
+			require.NotEmpty(t, result)
+			for _, p := range result {
+				assert.Zero(t, p.Timestamp.Unix()%interval, p.Timestamp)
+			}
+			assert.False(t, result[0].Timestamp.Before(r.From))
+			assert.True(t, result[0].Timestamp.Before(r.From.Add(time.Duration(interval)*time.Second)))
+		})
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  map[string]string
+		wantErr bool
+	}{
+		{"defaults", map[string]string{}, false},
+		{"query_job_limit", map[string]string{"query_job_limit": "50"}, false},
+		{"zero query_job_limit", map[string]string{"query_job_limit": "0"}, true},
+		{"invalid query_job_limit", map[string]string{"query_job_limit": "many"}, true},
+		{"negative sample_interval_secs", map[string]string{"sample_interval_secs": "-1"}, true},
+		{"project and group", map[string]string{"project": "group/app", "group": "group"}, true},
+		{"invalid tags", map[string]string{"tags": "/[/"}, true},
+		{"invalid exclude_stuck", map[string]string{"exclude_stuck": "maybe"}, true},
+		{"invalid auth_mode", map[string]string{"auth_mode": "basic"}, true},
+		{"oauth without token url", map[string]string{"auth_mode": authModeOAuth}, true},
+		{"invalid aggregation", map[string]string{"aggregation": "median"}, true},
+		{"invalid forecast_discount", map[string]string{"forecast_discount": "1.5"}, true},
+		{"NaN forecast_discount", map[string]string{"forecast_discount": "NaN"}, true},
+		{"weights", map[string]string{"weights": "tag:linux+large=1, name:lint-*=0.25"}, false},
+		{"invalid weight", map[string]string{"weights": "tag:large=big"}, true},
+		{"invalid weight selector", map[string]string{"weights": "stage:test=1"}, true},
+		{"NaN weight", map[string]string{"weights": "*=NaN"}, true},
+		{"infinite weight", map[string]string{"weights": "tag:gpu=Inf"}, true},
+		{"priority classes", map[string]string{"priority_rules": "source:schedule=batch, source:push&ref:main=interactive", "priority_weights": "batch=0.25"}, false},
+		{"invalid priority selector", map[string]string{"priority_rules": "stage:test=batch"}, true},
+		{"invalid priority class", map[string]string{"priority_rules": "source:schedule="}, true},
+		{"invalid priority weight", map[string]string{"priority_weights": "batch=low"}, true},
+		{"NaN priority weight", map[string]string{"priority_weights": "batch=NaN"}, true},
+		{"infinite priority weight", map[string]string{"priority_weights": "batch=Inf"}, true},
+		{"duplicate priority weight", map[string]string{"priority_weights": "batch=0.25, batch=0.5"}, true},
+		{"webhook without secret", map[string]string{"webhook_listen": "127.0.0.1:0"}, true},
+		{"webhook", map[string]string{"webhook_listen": "127.0.0.1:0", "webhook_secret": "secret"}, false},
+		{"instance", map[string]string{"instance.self.graphql_endpoint": "https://gitlab.example.com/api/graphql"}, false},
+		{"invalid instance key", map[string]string{"instance.self.tags": "linux"}, true},
+		{"invalid instance config", map[string]string{"instance.self.retry_max": "-1"}, true},
+		{"default instance name", map[string]string{"instance.default.token": token}, true},
+		{"unknown key", map[string]string{"query_jobs_limit": "50"}, true},
+		{"nomad keys", map[string]string{"nomad_address": "http://127.0.0.1:4646", "nomad_config_inherit": "true"}, false},
+		{"metrics", map[string]string{"metrics_listen": "127.0.0.1:0"}, false},
+		{"invalid metrics_listen", map[string]string{"metrics_listen": "127.0.0.1:-1"}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			plugin := NewGitLabPlugin(hclog.NewNullLogger()).(*APMPlugin)
+			err := plugin.SetConfig(c.config)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			for _, g := range plugin.instances {
+				g.stop()
+			}
+			if plugin.metricsServer != nil {
+				_ = plugin.metricsServer.Close()
+			}
+		})
+	}
+}
+
+func TestSetConfigErrors(t *testing.T) {
+	plugin := NewGitLabPlugin(hclog.NewNullLogger()).(*APMPlugin)
+
+	// every invalid key is reported at once
+	err := plugin.SetConfig(map[string]string{
+		"query_jobs_limit":                "50",
+		"sample_interval_secs":            "0",
+		"exclude_stuck":                   "maybe",
+		"instance.self.http_timeout_secs": "-1",
 	})
-	assert.NoError(t, err)
-	assert.NotNil(t, result)
-	assert.Greater(t, len(result), 0)
+	require.Error(t, err)
+	for _, key := range []string{"query_jobs_limit", "sample_interval_secs", "exclude_stuck", "instance.self.http_timeout_secs"} {
+		assert.Contains(t, err.Error(), key)
+	}
+}
+
+func TestMaskConfig(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		"graphql_endpoint":                 "https://gitlab.example.com/api/graphql",
+		"token":                            "*********",
+		"oauth_client_id":                  "client",
+		"oauth_client_secret":              "******",
+		"webhook_secret":                   "***",
+		"instance.dev.token":               "****",
+		"instance.dev.oauth_refresh_token": "*******",
+		"nomad_address":                    "http://127.0.0.1:4646",
+		"nomad_token":                      "*****",
+		"nomad_http-auth":                  "**********",
+	}, maskConfig(map[string]string{
+		"graphql_endpoint":                 "https://gitlab.example.com/api/graphql",
+		"token":                            token,
+		"oauth_client_id":                  "client",
+		"oauth_client_secret":              "secret",
+		"webhook_secret":                   "abc",
+		"instance.dev.token":               "abcd",
+		"instance.dev.oauth_refresh_token": "refresh",
+		"nomad_address":                    "http://127.0.0.1:4646",
+		"nomad_token":                      "nomad",
+		"nomad_http-auth":                  "user:passw",
+	}))
+}
+
+func TestSetConfigIdempotent(t *testing.T) {
+	fake := newFakeGitLab(t)
+	plugin := newTestPlugin(t, fake, map[string]string{"tags": "linux"})
+	query := func() float64 {
+		result, err := plugin.Query("", fixtureRange)
+		require.NoError(t, err)
+		return valueAt(t, result, fixtureRange.To)
+	}
+	assert.Equal(t, 3.0, query())
+
+	// the same config again
+	require.NoError(t, plugin.SetConfig(map[string]string{"graphql_endpoint": fake.server.URL, "token": token, "tags": "linux"}))
+	assert.Equal(t, 3.0, query())
+
+	// an invalid config keeps the previous one
+	require.Error(t, plugin.SetConfig(map[string]string{"graphql_endpoint": fake.server.URL, "token": token, "tags": "-linux", "cache_ttl_secs": "-1"}))
+	assert.Equal(t, 3.0, query())
+
+	// nothing is left over from the previous config
+	require.NoError(t, plugin.SetConfig(map[string]string{"graphql_endpoint": fake.server.URL, "token": token}))
+	assert.Equal(t, 4.0, query())
+}
+
+func TestSetConfigListenFailure(t *testing.T) {
+	fake := newFakeGitLab(t)
+	config := map[string]string{"graphql_endpoint": fake.server.URL, "token": token, "tags": "linux", "metrics_listen": "127.0.0.1:0"}
+	plugin := newTestPlugin(t, fake, config)
+	t.Cleanup(plugin.stop)
+	query := func() float64 {
+		result, err := plugin.Query("", fixtureRange)
+		require.NoError(t, err)
+		return valueAt(t, result, fixtureRange.To)
+	}
+	scrape := func() {
+		require.NotNil(t, plugin.metricsServer)
+		resp, err := http.Get("http://" + plugin.metricsServer.Addr + "/metrics")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, 3.0, query())
+	scrape()
+
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = used.Close() })
+
+	// a config that cannot listen keeps the previous one, listeners included
+	for _, key := range []string{"metrics_listen", "webhook_listen"} {
+		next := maps.Clone(config)
+		next["tags"] = ""
+		next["webhook_secret"] = "secret"
+		next[key] = used.Addr().String()
+		require.ErrorContains(t, plugin.SetConfig(next), "unable to listen", key)
+		assert.Equal(t, 3.0, query(), key)
+		scrape()
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	fake := newFakeGitLab(t)
+	plugin := newTestPlugin(t, fake, nil)
+
+	cases := []struct {
+		query string
+		key   string
+	}{
+		{`metric:"queued"`, queryKeyMetric},
+		{`metric:"wait_p0"`, queryKeyMetric},
+		{`metric:"wait_pNaN"`, queryKeyMetric},
+		{`metric:"wait_pInf"`, queryKeyMetric},
+		{`tag:"linux"`, "tag"},
+		{`tags:"/[/"`, queryKeyTags},
+		{`exclude_stuck:"maybe"`, queryKeyExcludeStuck},
+		{`instance:"self"`, queryKeyInstance},
+		{`metric:"wait_avg" aggregation:"max"`, queryKeyAggregation},
+		{`weights:"*=NaN"`, queryKeyWeights},
+		{`metric:"forecast" forecast_discount:"NaN"`, queryKeyForecastDiscount},
+		{`metric:"runners_online" group_by:"tag"`, queryKeyGroupBy},
+		{`group_by:"status" group_aggregation:"max"`, queryKeyGroupBy},
+		// a single group, but it would fail once there are more
+		{`group_by:"tag" tags:"windows"`, queryKeyGroupAggregation},
+		{`tags:"linux`, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.query, func(t *testing.T) {
+			_, err := plugin.Query(c.query, fixtureRange)
+			var queryErr *QueryError
+			require.ErrorAs(t, err, &queryErr)
+			assert.Equal(t, c.key, queryErr.Key)
+		})
+	}
+}
+
+func TestScopeNotFound(t *testing.T) {
+	fake := newFakeGitLab(t)
+	plugin := newTestPlugin(t, fake, nil)
+
+	// GitLab returns null for paths that do not exist or that the token cannot access, which must not read as no jobs
+	for _, query := range []string{`project:"group/missing"`, `group:"missing"`, `metric:"runners_online" group:"missing"`} {
+		t.Run(query, func(t *testing.T) {
+			_, err := plugin.Query(query, fixtureRange)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "missing is not found")
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	fake := newFakeGitLab(t)
+	fake.pageSize = 2
+	plugin := newTestPlugin(t, fake, nil)
+
+	jobs, err := plugin.instances[defaultInstanceName].listJobs(context.Background(), jobScope{}, 200, fixtureRange.From, false)
+	require.NoError(t, err)
+
+	// active jobs: 2 pages; finished jobs: newest first, listing stops after the page reaching job 7 created at 10:00
+	assert.Len(t, jobs, 9)
+	assert.Equal(t, 5, fake.requestCount("getAllJobs"))
+
+	// upcoming jobs: 1 page
+	jobs, err = plugin.instances[defaultInstanceName].listJobs(context.Background(), jobScope{}, 200, fixtureRange.From, true)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 10)
+	assert.Equal(t, 11, fake.requestCount("getAllJobs"))
+
+	// query_job_limit
+	jobs, err = plugin.instances[defaultInstanceName].listJobs(context.Background(), jobScope{}, 3, fixtureRange.From, false)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 3)
+}
+
+func TestFinishedJobLookback(t *testing.T) {
+	// job 10 is created at 11:01, and runs from 11:25 to 11:35
+	r := sdk.TimeRange{From: fixtureRange.From.Add(30 * time.Minute), To: fixtureRange.To}
+
+	cases := []struct {
+		name     string
+		lookback string
+		want     float64
+	}{
+		{"default", "3600", 1},
+		// listing stops at the page reaching job 2 created at 11:05
+		{"disabled", "0", 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fake := newFakeGitLab(t)
+			fake.pageSize = 2
+			plugin := newTestPlugin(t, fake, map[string]string{"finished_job_lookback_secs": c.lookback})
+
+			result, err := plugin.Query(`metric:"running" names:"deploy"`, r)
+			require.NoError(t, err)
+			assert.Equal(t, c.want, valueAt(t, result, r.From))
+		})
+	}
+}
+
+func TestErrorInjection(t *testing.T) {
+	cases := []struct {
+		name     string
+		failures []fakeFailure
+		wantErr  bool
+		requests int
+	}{
+		{"retried", []fakeFailure{{http.StatusServiceUnavailable, "unavailable", nil}, {http.StatusTooManyRequests, "slow down", nil}}, false, 4},
+		{"retries exhausted", []fakeFailure{{http.StatusBadGateway, "", nil}, {http.StatusBadGateway, "", nil}, {http.StatusBadGateway, "", nil}, {http.StatusBadGateway, "", nil}}, true, 4},
+		{"not retryable", []fakeFailure{{http.StatusInternalServerError, "oops", nil}}, true, 1},
+		{"graphql error", []fakeFailure{{http.StatusOK, "Field 'jobs' doesn't exist", nil}}, true, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fake := newFakeGitLab(t)
+			plugin := newTestPlugin(t, fake, map[string]string{"retry_max": "3"})
+			fake.fail(c.failures...)
+
+			_, err := plugin.Query("", fixtureRange)
+			if c.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, c.requests, fake.requestCount("getAllJobs"))
+		})
+	}
+}
+
+func TestServerRequestedWaits(t *testing.T) {
+	rateLimited := func(reset time.Duration) http.Header {
+		return http.Header{
+			"Ratelimit-Remaining": {"0"},
+			"Ratelimit-Reset":     {strconv.FormatInt(time.Now().Add(reset).Unix(), 10)},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		config   map[string]string
+		failure  fakeFailure
+		wantErr  bool
+		requests int
+		minWait  time.Duration
+	}{
+		{"retry after", nil, fakeFailure{http.StatusTooManyRequests, "slow down", http.Header{"Retry-After": {"1"}}}, false, 3, time.Second},
+		{"retry after too long", nil, fakeFailure{http.StatusTooManyRequests, "slow down", http.Header{"Retry-After": {"3600"}}}, true, 1, 0},
+		{"rate limit", nil, fakeFailure{http.StatusServiceUnavailable, "", rateLimited(time.Second)}, false, 3, 0},
+		{"rate limit too long", nil, fakeFailure{http.StatusServiceUnavailable, "", rateLimited(time.Hour)}, true, 1, 0},
+		{"listing deadline", map[string]string{"list_timeout_secs": "1"}, fakeFailure{http.StatusTooManyRequests, "slow down", http.Header{"Retry-After": {"2"}}}, true, 1, time.Second},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fake := newFakeGitLab(t)
+			config := map[string]string{"retry_max_backoff_ms": "2000"}
+			maps.Copy(config, c.config)
+			plugin := newTestPlugin(t, fake, config)
+			fake.fail(c.failure)
+
+			start := time.Now()
+			_, err := plugin.Query("", fixtureRange)
+			if c.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, c.requests, fake.requestCount("getAllJobs"))
+			assert.GreaterOrEqual(t, time.Since(start), c.minWait)
+			assert.Less(t, time.Since(start), 2*time.Second)
+		})
+	}
+}
+
+func TestStaleSnapshot(t *testing.T) {
+	fake := newFakeGitLab(t)
+	plugin := newTestPlugin(t, fake, map[string]string{"cache_ttl_secs": "0", "stale_snapshot_secs": "60"})
+
+	result, err := plugin.Query("", fixtureRange)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, valueAt(t, result, fixtureRange.To))
+
+	// GitLab is down; the last good listing is served
+	fake.fail(fakeFailure{http.StatusInternalServerError, "oops", nil})
+	result, err = plugin.Query("", fixtureRange)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, valueAt(t, result, fixtureRange.To))
+	assert.Equal(t, 3, fake.requestCount("getAllJobs"))
+
+	// a listing not covering the time range is not served
+	fake.fail(fakeFailure{http.StatusInternalServerError, "oops", nil})
+	_, err = plugin.Query("", sdk.TimeRange{From: fixtureRange.From.Add(-time.Hour), To: fixtureRange.To})
+	assert.Error(t, err)
+}
+
+func TestSelfMetrics(t *testing.T) {
+	fake := newFakeGitLab(t)
+	plugin := newTestPlugin(t, fake, nil)
+
+	_, err := plugin.Query("", fixtureRange)
+	require.NoError(t, err)
+	_, err = plugin.Query("", fixtureRange)
+	require.NoError(t, err)
+	fake.fail(fakeFailure{http.StatusInternalServerError, "oops", nil})
+	_, err = plugin.Query(`metric:"runner_slots_idle"`, fixtureRange)
+	require.Error(t, err)
+
+	var b strings.Builder
+	require.NoError(t, plugin.metrics.write(&b))
+	metrics := b.String()
+	for _, line := range []string{
+		// the active and the finished jobs
+		`gitlab_apm_graphql_request_duration_seconds_count{gitlab_instance="default",operation="getAllJobs"} 2`,
+		`gitlab_apm_graphql_errors_total{gitlab_instance="default",operation="getAllRunners"} 1`,
+		`gitlab_apm_jobs_fetched_total{gitlab_instance="default",status="RUNNING"} 1`,
+		`gitlab_apm_jobs_listed{gitlab_instance="default",status="SUCCESS"} 3`,
+		`gitlab_apm_jobs_listed{gitlab_instance="default",status="CREATED"} 0`,
+		`gitlab_apm_cache_requests_total{gitlab_instance="default",listing="jobs",result="hit"} 2`,
+		`gitlab_apm_cache_requests_total{gitlab_instance="default",listing="jobs",result="miss"} 1`,
+		`gitlab_apm_query_duration_seconds_count{query=""} 2`,
+		`gitlab_apm_query_errors_total{query="metric:\"runner_slots_idle\""} 1`,
+	} {
+		assert.Contains(t, metrics, line+"\n")
+	}
+
+	// the metrics are kept across reloads
+	require.NoError(t, plugin.SetConfig(map[string]string{"graphql_endpoint": fake.server.URL, "token": token, "metrics_listen": "127.0.0.1:0"}))
+	defer plugin.metricsServer.Close()
+
+	resp, err := http.Get("http://" + plugin.metricsServer.Addr + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `gitlab_apm_query_errors_total{query="metric:\"runner_slots_idle\""} 1`)
 }
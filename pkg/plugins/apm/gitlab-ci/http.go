@@ -0,0 +1,64 @@
+package gitlab_ci
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+)
+
+// newHttpTransport creates the transport used to talk to GitLab from the plugin config.
+func newHttpTransport(config map[string]string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config["proxy_url"] != "" {
+		proxyUrl, err := neturl.Parse(config["proxy_url"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse proxy_url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config["ca_file"] != "" {
+		pem, err := os.ReadFile(config["ca_file"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca_file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca_file %s", config["ca_file"])
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config["client_cert_file"] == "") != (config["client_key_file"] == "") {
+		return nil, fmt.Errorf("client_cert_file and client_key_file must be set together")
+	}
+	if config["client_cert_file"] != "" {
+		cert, err := tls.LoadX509KeyPair(config["client_cert_file"], config["client_key_file"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	skipVerify, err := strconv.ParseBool(config["tls_skip_verify"])
+	if err != nil {
+		return nil, fmt.Errorf("tls_skip_verify must be a boolean, got %s instead: %w", config["tls_skip_verify"], err)
+	}
+	tlsConfig.InsecureSkipVerify = skipVerify
+
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
@@ -0,0 +1,260 @@
+package gitlab_ci
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hasura/go-graphql-client"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// the instance configured by the top level config keys
+	defaultInstanceName = "default"
+
+	// named instances are configured by "instance.<name>.<key>" config keys
+	instanceConfigPrefix = "instance."
+)
+
+var (
+	// config keys that are set per instance; the other config keys apply to all the instances
+	instanceConfigKeys = []string{
+		"graphql_endpoint", "token", "token_file", "auth_mode",
+		"oauth_token_url", "oauth_client_id", "oauth_client_secret", "oauth_refresh_token", "oauth_scopes",
+		"query_job_limit", "finished_job_lookback_secs", "project", "group", "cache_ttl_secs", "stale_snapshot_secs",
+		"webhook_listen", "webhook_secret", "webhook_reconcile_secs", "webhook_retention_secs",
+		"http_timeout_secs", "list_timeout_secs", "proxy_url", "ca_file", "client_cert_file", "client_key_file", "tls_skip_verify",
+		"retry_max", "retry_min_backoff_ms", "retry_max_backoff_ms",
+	}
+
+	instanceNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// gitlabInstance is a GitLab instance that jobs and runners are listed from.
+type gitlabInstance struct {
+	name   string
+	logger hclog.Logger
+
+	queryJobLimit int
+	// deadline of listing the jobs or the runners of a scope, retries and rate limit waits included
+	listTimeout time.Duration
+	// how long before the queried time range the finished jobs are still listed, i.e. the longest job duration expected
+	finishedJobLookback time.Duration
+	scope               jobScope
+
+	gqlClient *graphql.Client
+	metrics   *metricsRegistry
+
+	jobCache    *snapshotCache[[]jobNode]
+	runnerCache *snapshotCache[[]runnerNode]
+
+	// nil if webhook is disabled
+	webhook *webhookServer
+}
+
+// instanceConfigs splits the named instances' config keys out of the plugin config, and fills the missing ones with
+// the default config. The top level config keys are not inherited by named instances. Invalid keys are reported to p.
+func instanceConfigs(config map[string]string, p *configParser) map[string]map[string]string {
+	ret := make(map[string]map[string]string)
+
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		rest, ok := strings.CutPrefix(k, instanceConfigPrefix)
+		if !ok {
+			continue
+		}
+
+		name, key, ok := strings.Cut(rest, ".")
+		if !ok || !instanceNameRegexp.MatchString(name) || name == defaultInstanceName {
+			p.errorf(k, "must be %s<name>.<key>, where the name is not %q", instanceConfigPrefix, defaultInstanceName)
+			continue
+		}
+		if !slices.Contains(instanceConfigKeys, key) {
+			p.errorf(k, "%s cannot be set per instance", key)
+			continue
+		}
+
+		if _, ok := ret[name]; !ok {
+			ret[name] = make(map[string]string)
+			for _, ik := range instanceConfigKeys {
+				ret[name][ik] = defaultConfig[ik]
+			}
+		}
+		ret[name][key] = config[k]
+	}
+
+	return ret
+}
+
+// newGitlabInstance creates an instance from the config keys in instanceConfigKeys. It has no side effects, so that
+// the previous instances keep working if any of the new ones is invalid; call start to start its webhook server.
+func newGitlabInstance(name string, config map[string]string, logger hclog.Logger, metrics *metricsRegistry) (*gitlabInstance, error) {
+	g := &gitlabInstance{
+		name:    name,
+		logger:  logger,
+		metrics: metrics,
+	}
+
+	p := &configParser{config: config}
+	if name != defaultInstanceName {
+		p.prefix = instanceConfigPrefix + name + "."
+	}
+
+	g.queryJobLimit = p.positiveInt("query_job_limit")
+	g.listTimeout = p.positiveSeconds("list_timeout_secs")
+	g.finishedJobLookback = p.nonNegativeSeconds("finished_job_lookback_secs")
+	cacheTtl := p.nonNegativeSeconds("cache_ttl_secs")
+	maxStale := p.nonNegativeSeconds("stale_snapshot_secs")
+	g.jobCache = newSnapshotCache[[]jobNode](logger, cacheTtl, maxStale)
+	g.runnerCache = newSnapshotCache[[]runnerNode](logger, cacheTtl, maxStale)
+
+	if config["project"] != "" && config["group"] != "" {
+		p.errorf("project", "cannot be set at the same time as group")
+	}
+	g.scope = jobScope{project: config["project"], group: config["group"]}
+
+	timeout := p.positiveSeconds("http_timeout_secs")
+	retryMax := p.nonNegativeInt("retry_max")
+	retryMinBackoff := p.nonNegativeMilliseconds("retry_min_backoff_ms")
+	retryMaxBackoff := p.nonNegativeMilliseconds("retry_max_backoff_ms")
+
+	if config["webhook_listen"] != "" {
+		if config["webhook_secret"] == "" {
+			p.errorf("webhook_secret", "is required if webhook_listen is set")
+		}
+
+		g.webhook = &webhookServer{
+			logger:   logger.Named("webhook"),
+			secret:   config["webhook_secret"],
+			table:    newJobTable(logger.Named("webhook"), p.positiveSeconds("webhook_reconcile_secs"), p.positiveSeconds("webhook_retention_secs"), maxStale),
+			fetchJob: g.fetchJob,
+			address:  config["webhook_listen"],
+		}
+	}
+
+	// errors from building the transports name the keys themselves
+	wrap := func(err error) error {
+		if name == defaultInstanceName {
+			return err
+		}
+		return fmt.Errorf("instance %s: %w", name, err)
+	}
+
+	transport, err := newHttpTransport(config)
+	if err != nil {
+		p.errs = append(p.errs, wrap(err))
+	} else if transport.TLSClientConfig.InsecureSkipVerify {
+		logger.Warn("TLS certificate verification is disabled, do not use this in production")
+	}
+
+	retryingTransport := &retryingHttpTransport{
+		logger:     logger,
+		next:       transport,
+		timeout:    timeout,
+		maxRetries: retryMax,
+		minBackoff: retryMinBackoff,
+		maxBackoff: retryMaxBackoff,
+	}
+	authTransport, err := newAuthenticatedHttpTransport(config, retryingTransport)
+	if err != nil {
+		p.errs = append(p.errs, wrap(err))
+	}
+
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	g.gqlClient = graphql.NewClient(config["graphql_endpoint"], &http.Client{
+		Transport: authTransport,
+	})
+
+	return g, nil
+}
+
+// start starts the instance's webhook server if configured.
+func (g *gitlabInstance) start() error {
+	if g.webhook == nil {
+		return nil
+	}
+
+	return g.webhook.start()
+}
+
+// query runs a GraphQL query, and records its duration and errors.
+func (g *gitlabInstance) query(ctx context.Context, operation string, q interface{}, variables map[string]interface{}) error {
+	defer g.metrics.since(selfMetricGraphQLDuration, time.Now(), selfMetricLabelInstance, g.name, "operation", operation)
+
+	err := g.gqlClient.Query(ctx, q, variables, graphql.OperationName(operation))
+	if err != nil {
+		g.metrics.add(selfMetricGraphQLErrors, 1, selfMetricLabelInstance, g.name, "operation", operation)
+	}
+	return err
+}
+
+// stop releases the resources held by the instance.
+func (g *gitlabInstance) stop() {
+	if g.webhook != nil {
+		g.webhook.stop()
+	}
+}
+
+// getJobs lists the jobs in the scope covering the time range starting at notBefore, from the job table kept by
+// webhook events if enabled, or from the API otherwise. Upcoming jobs are only included if upcoming is set.
+func (g *gitlabInstance) getJobs(scope jobScope, notBefore time.Time, upcoming bool) ([]jobNode, bool, error) {
+	if g.webhook == nil {
+		key := scope.String()
+		if upcoming {
+			key += "+upcoming"
+		}
+		return g.jobCache.get(key, notBefore, func() ([]jobNode, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), g.listTimeout)
+			defer cancel()
+			return g.listJobs(ctx, scope, g.queryJobLimit, notBefore, upcoming)
+		})
+	}
+
+	// the job table has to be reconciled with what the API says right now, so the cache is not used; job events are
+	// received for upcoming jobs anyway, so they are always listed
+	return g.webhook.table.get(scope, notBefore, func() ([]jobNode, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), g.listTimeout)
+		defer cancel()
+		return g.listJobs(ctx, scope, g.queryJobLimit, notBefore, true)
+	})
+}
+
+// getRunners lists the runners in the scope.
+func (g *gitlabInstance) getRunners(scope jobScope) ([]runnerNode, bool, error) {
+	return g.runnerCache.get(scope.String(), time.Time{}, func() ([]runnerNode, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), g.listTimeout)
+		defer cancel()
+		return g.listRunners(ctx, scope)
+	})
+}
+
+// qualifyIds prefixes the job and runner IDs with the instance name, since IDs are only unique within an instance.
+// The slices given are shared with the caches, so copies are returned.
+func (g *gitlabInstance) qualifyIds(jobs []jobNode, runners []runnerNode) ([]jobNode, []runnerNode) {
+	jobs = slices.Clone(jobs)
+	for i := range jobs {
+		jobs[i].ID = g.name + "/" + jobs[i].ID
+		if jobs[i].Runner.ID != "" {
+			jobs[i].Runner.ID = g.name + "/" + jobs[i].Runner.ID
+		}
+	}
+
+	runners = slices.Clone(runners)
+	for i := range runners {
+		runners[i].ID = g.name + "/" + runners[i].ID
+	}
+
+	return jobs, runners
+}
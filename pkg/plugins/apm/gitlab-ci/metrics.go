@@ -0,0 +1,230 @@
+package gitlab_ci
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metricKind string
+
+const (
+	metricKindCounter   metricKind = "counter"
+	metricKindGauge     metricKind = "gauge"
+	metricKindHistogram metricKind = "histogram"
+)
+
+const (
+	selfMetricGraphQLDuration = "gitlab_apm_graphql_request_duration_seconds"
+	selfMetricGraphQLErrors   = "gitlab_apm_graphql_errors_total"
+	selfMetricJobsFetched     = "gitlab_apm_jobs_fetched_total"
+	selfMetricJobsListed      = "gitlab_apm_jobs_listed"
+	selfMetricJobsFiltered    = "gitlab_apm_jobs_filtered_total"
+	selfMetricCacheRequests   = "gitlab_apm_cache_requests_total"
+	selfMetricQueryDuration   = "gitlab_apm_query_duration_seconds"
+	selfMetricQueryErrors     = "gitlab_apm_query_errors_total"
+
+	// not "instance", which Prometheus sets to the scraped target
+	selfMetricLabelInstance = "gitlab_instance"
+)
+
+var (
+	// seconds, from a single GraphQL page to a whole group listing
+	selfMetricDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+	selfMetricDefinitions = map[string]struct {
+		kind metricKind
+		help string
+	}{
+		selfMetricGraphQLDuration: {metricKindHistogram, "Duration of GraphQL requests to GitLab, retries included."},
+		selfMetricGraphQLErrors:   {metricKindCounter, "GraphQL requests to GitLab that failed."},
+		selfMetricJobsFetched:     {metricKindCounter, "Jobs returned by GraphQL requests to GitLab."},
+		selfMetricJobsListed:      {metricKindGauge, "Jobs in the last listing of a scope, cached or not."},
+		selfMetricJobsFiltered:    {metricKindCounter, "Jobs listed but filtered out by queries."},
+		selfMetricCacheRequests:   {metricKindCounter, "Listings requested from the cache or the webhook job table, by whether they are served without calling GitLab."},
+		selfMetricQueryDuration:   {metricKindHistogram, "Duration of APM queries."},
+		selfMetricQueryErrors:     {metricKindCounter, "APM queries that failed."},
+	}
+)
+
+// metricSeries is a metric with a set of labels.
+type metricSeries struct {
+	labels []string
+	value  float64
+	// histograms only
+	buckets []uint64
+	count   uint64
+}
+
+// metricsRegistry keeps the plugin's own metrics, and exposes them in the Prometheus text format. The plugin runs in its
+// own process, so it cannot report to nomad-autoscaler's telemetry sinks.
+type metricsRegistry struct {
+	lock   sync.Mutex
+	series map[string]map[string]*metricSeries
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		series: make(map[string]map[string]*metricSeries),
+	}
+}
+
+// get returns the series of the metric with the labels, given as name-value pairs. Must be called with the lock held.
+func (r *metricsRegistry) get(name string, labels []string) *metricSeries {
+	if _, ok := selfMetricDefinitions[name]; !ok || len(labels)%2 != 0 {
+		panic(fmt.Sprintf("invalid metric %s %v", name, labels))
+	}
+
+	if _, ok := r.series[name]; !ok {
+		r.series[name] = make(map[string]*metricSeries)
+	}
+
+	key := strings.Join(labels, "\x00")
+	s, ok := r.series[name][key]
+	if !ok {
+		s = &metricSeries{labels: slices.Clone(labels)}
+		if selfMetricDefinitions[name].kind == metricKindHistogram {
+			s.buckets = make([]uint64, len(selfMetricDurationBuckets))
+		}
+		r.series[name][key] = s
+	}
+	return s
+}
+
+// add adds to a counter.
+func (r *metricsRegistry) add(name string, v float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.get(name, labels).value += v
+}
+
+// set sets a gauge.
+func (r *metricsRegistry) set(name string, v float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.get(name, labels).value = v
+}
+
+// observe adds an observation to a histogram.
+func (r *metricsRegistry) observe(name string, v float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s := r.get(name, labels)
+	s.value += v
+	s.count++
+	for i, b := range selfMetricDurationBuckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+// since observes the time elapsed since start in a histogram.
+func (r *metricsRegistry) since(name string, start time.Time, labels ...string) {
+	r.observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// write writes every metric in the Prometheus text format.
+func (r *metricsRegistry) write(w io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, 0, len(r.series))
+	for name := range r.series {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		definition := selfMetricDefinitions[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, definition.help, name, definition.kind)
+
+		keys := make([]string, 0, len(r.series[name]))
+		for key := range r.series[name] {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			s := r.series[name][key]
+			if definition.kind != metricKindHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", name, formatLabels(s.labels), formatValue(s.value))
+				continue
+			}
+
+			for i, bucket := range selfMetricDurationBuckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(append(slices.Clone(s.labels), "le", formatValue(bucket))), s.buckets[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(append(slices.Clone(s.labels), "le", "+Inf")), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, formatLabels(s.labels), formatValue(s.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, formatLabels(s.labels), s.count)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i := 0; i < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (r *metricsRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.write(rw)
+}
+
+// startMetricsServer listens on the address and serves the metrics at /metrics in background.
+func startMetricsServer(logger hclog.Logger, address string, r *metricsRegistry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	server := &http.Server{
+		// informational only, the listener is already bound; useful when the port is picked by the system
+		Addr:              listener.Addr().String(),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server stopped", "error", err)
+		}
+	}()
+
+	logger.Info("metrics server started", "address", listener.Addr())
+	return server, nil
+}
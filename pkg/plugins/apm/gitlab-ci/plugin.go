@@ -1,20 +1,16 @@
 package gitlab_ci
 
 import (
-	"context"
 	"fmt"
 	"github.com/Jamesits/nomad-autoscaler-plugins/pkg/utils"
-	"github.com/fatih/structtag"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-autoscaler/plugins/apm"
 	"github.com/hashicorp/nomad-autoscaler/plugins/base"
 	"github.com/hashicorp/nomad-autoscaler/sdk"
-	"github.com/hasura/go-graphql-client"
 	"maps"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
+	"slices"
 	"time"
 )
 
@@ -29,11 +25,48 @@ var (
 	}
 
 	defaultConfig = map[string]string{
-		"graphql_endpoint":     "https://gitlab.com/api/graphql",
-		"token":                "",
-		"query_job_limit":      "200",
-		"sample_interval_secs": "60",
-		"tags":                 "",
+		"graphql_endpoint":           "https://gitlab.com/api/graphql",
+		"token":                      "",
+		"token_file":                 "",
+		"auth_mode":                  authModeBearer,
+		"oauth_token_url":            "",
+		"oauth_client_id":            "",
+		"oauth_client_secret":        "",
+		"oauth_refresh_token":        "",
+		"oauth_scopes":               "",
+		"query_job_limit":            "200",
+		"finished_job_lookback_secs": "3600",
+		"sample_interval_secs":       "60",
+		"tags":                       "",
+		"project":                    "",
+		"group":                      "",
+		"runner_concurrency":         "1",
+		"cache_ttl_secs":             "10",
+		"exclude_stuck":              "false",
+		"max_pending_age_secs":       "0",
+		"latency_window_secs":        "900",
+		"aggregation":                aggregationInstant,
+		"sample_align":               "false",
+		"weights":                    "",
+		"forecast_discount":          "0.5",
+		"priority_rules":             "",
+		"priority_weights":           "",
+		"webhook_listen":             "",
+		"webhook_secret":             "",
+		"webhook_reconcile_secs":     "300",
+		"webhook_retention_secs":     "3600",
+		"http_timeout_secs":          "30",
+		"list_timeout_secs":          "300",
+		"proxy_url":                  "",
+		"ca_file":                    "",
+		"client_cert_file":           "",
+		"client_key_file":            "",
+		"tls_skip_verify":            "false",
+		"retry_max":                  "3",
+		"retry_min_backoff_ms":       "500",
+		"retry_max_backoff_ms":       "30000",
+		"stale_snapshot_secs":        "0",
+		"metrics_listen":             "",
 	}
 )
 
@@ -44,12 +77,27 @@ type APMPlugin struct {
 	logger hclog.Logger
 
 	config         map[string]string
-	queryJobLimit  int
 	sampleInterval time.Duration
-	includeTags    []string
-	excludeTags    []string
+	tags           *utils.Filter
+	excludeStuck   bool
+	maxPendingAge  time.Duration
+	latencyWindow  time.Duration
+	aggregation    string
+	sampleAlign    bool
+	weights        []jobWeight
+	// how much an upcoming job counts in the forecast
+	forecastDiscount float64
+	priorityRules    []priorityRule
+	priorityWeights  map[string]float64
+	// GitLab does not expose the runners' concurrent setting, so it has to be configured
+	runnerConcurrency int
 
-	gqlClient *graphql.Client
+	// the default instance, and the named ones
+	instances map[string]*gitlabInstance
+
+	// kept across SetConfig calls, so that counters do not reset on reloads
+	metrics       *metricsRegistry
+	metricsServer *http.Server
 }
 
 func NewGitLabPlugin(log hclog.Logger) apm.APM {
@@ -64,128 +112,297 @@ func (n *APMPlugin) PluginInfo() (*base.PluginInfo, error) {
 }
 
 func (n *APMPlugin) SetConfig(config map[string]string) error {
-	n.logger.Debug("SetConfig() called", "config", config)
+	n.logger.Debug("SetConfig() called", "config", maskConfig(config))
 
-	n.config = make(map[string]string)
+	// the new config is parsed on its own and only replaces the current one if it is valid, so that nothing is left over
+	// from the previous config, and the plugin keeps working with the previous config otherwise
+	next := &APMPlugin{
+		logger:  n.logger,
+		config:  make(map[string]string),
+		metrics: n.metrics,
+	}
+	if next.metrics == nil {
+		next.metrics = newMetricsRegistry()
+	}
 	// copy from default config
-	maps.Copy(n.config, defaultConfig)
+	maps.Copy(next.config, defaultConfig)
 	// apply environment variables
 	if os.Getenv("GITLAB_GRAPHQL_ENDPOINT") != "" {
-		n.config["graphql_endpoint"] = os.Getenv("GITLAB_GRAPHQL_ENDPOINT")
+		next.config["graphql_endpoint"] = os.Getenv("GITLAB_GRAPHQL_ENDPOINT")
 	}
 	if os.Getenv("GITLAB_TOKEN") != "" {
-		n.config["token"] = os.Getenv("GITLAB_TOKEN")
+		next.config["token"] = os.Getenv("GITLAB_TOKEN")
+	}
+	if config["auth_mode"] == authModeJobToken && os.Getenv("CI_JOB_TOKEN") != "" {
+		next.config["token"] = os.Getenv("CI_JOB_TOKEN")
 	}
 	// copy from user config
-	maps.Copy(n.config, config)
+	maps.Copy(next.config, config)
 
 	// debug print parsed config
-	for k, v := range n.config {
-		if k == "token" {
-			n.logger.Trace("config item received", "token", strings.Repeat("*", len(v)))
+	for k, v := range maskConfig(next.config) {
+		n.logger.Trace("config item received", k, v)
+	}
+
+	p := &configParser{config: next.config}
+	p.unknownKeys(config)
+
+	next.sampleInterval = p.positiveSeconds("sample_interval_secs")
+	next.runnerConcurrency = p.positiveInt("runner_concurrency")
+	next.excludeStuck = p.bool("exclude_stuck")
+	next.maxPendingAge = p.nonNegativeSeconds("max_pending_age_secs")
+	next.latencyWindow = p.positiveSeconds("latency_window_secs")
+	next.aggregation = p.oneOf("aggregation", supportedAggregations)
+	next.sampleAlign = p.bool("sample_align")
+	next.forecastDiscount = p.fraction("forecast_discount")
+
+	var err error
+	next.weights, err = parseWeights(next.config["weights"])
+	if err != nil {
+		p.errorf("weights", "%v", err)
+	}
+
+	next.priorityRules, err = parsePriorityRules(next.config["priority_rules"])
+	if err != nil {
+		p.errorf("priority_rules", "%v", err)
+	}
+
+	next.priorityWeights, err = parsePriorityWeights(next.config["priority_weights"])
+	if err != nil {
+		p.errorf("priority_weights", "%v", err)
+	}
+
+	next.tags, err = utils.ParseFilter(next.config["tags"])
+	if err != nil {
+		p.errorf("tags", "%v", err)
+	}
+
+	configs := instanceConfigs(config, p)
+	configs[defaultInstanceName] = next.config
+
+	next.instances = make(map[string]*gitlabInstance)
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		logger := n.logger
+		if name != defaultInstanceName {
+			logger = n.logger.Named(name)
+		}
+
+		g, err := newGitlabInstance(name, configs[name], logger, next.metrics)
+		if err != nil {
+			p.errs = append(p.errs, err)
 			continue
 		}
+		next.instances[name] = g
+	}
 
-		n.logger.Trace("config item received", k, v)
+	if err := p.err(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
 	}
 
-	l, err := strconv.ParseInt(n.config["query_job_limit"], 10, 64)
-	if err != nil || l <= 0 {
-		return fmt.Errorf("query_job_limit must be an positive integer, got %s instead: %w", n.config["query_job_limit"], err)
+	// stop the previous listeners first, so that their addresses can be reused, and start them again if the new ones
+	// cannot listen
+	n.stop()
+	if err := next.start(); err != nil {
+		if err := n.start(); err != nil {
+			n.logger.Error("unable to restart the previous listeners", "error", err)
+		}
+		return err
 	}
-	n.queryJobLimit = int(l)
+	*n = *next
+
+	return nil
+}
 
-	l, err = strconv.ParseInt(n.config["sample_interval_secs"], 10, 64)
-	if err != nil || l <= 0 {
-		return fmt.Errorf("sample_interval_secs must be an positive integer, got %s instead: %w", n.config["sample_interval_secs"], err)
+// start starts the instances' webhook servers and the metrics server; if any of them fails, the ones already started
+// are stopped again.
+func (n *APMPlugin) start() error {
+	names := make([]string, 0, len(n.instances))
+	for name := range n.instances {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := n.instances[name].start(); err != nil {
+			n.stop()
+			if name == defaultInstanceName {
+				return err
+			}
+			return fmt.Errorf("instance %s: %w", name, err)
+		}
 	}
-	n.sampleInterval = time.Second * time.Duration(l)
 
-	i, e := utils.SplitTags(n.config["tags"])
-	n.includeTags = append(n.includeTags, i...)
-	n.excludeTags = append(n.excludeTags, e...)
+	if address := n.config["metrics_listen"]; address != "" {
+		var err error
+		n.metricsServer, err = startMetricsServer(n.logger, address, n.metrics)
+		if err != nil {
+			n.stop()
+			return err
+		}
+	}
 
-	// TODO: custom HTTP timeout
-	n.gqlClient = graphql.NewClient(n.config["graphql_endpoint"], &http.Client{
-		Transport: &authenticatedHttpTransport{authHeader: "Bearer " + n.config["token"]},
-	})
 	return nil
 }
 
-func (n *APMPlugin) QueryMultiple(q string, r sdk.TimeRange) ([]sdk.TimestampedMetrics, error) {
-	n.logger.Debug("QueryMultiple() called", "q", q, "range", r)
-	m, err := n.Query(q, r)
-	if err != nil {
-		return nil, err
+// stop stops the listeners started by start.
+func (n *APMPlugin) stop() {
+	for _, g := range n.instances {
+		g.stop()
+	}
+	if n.metricsServer != nil {
+		_ = n.metricsServer.Close()
+		n.metricsServer = nil
 	}
-	return []sdk.TimestampedMetrics{m}, nil
 }
 
 func (n *APMPlugin) Query(q string, r sdk.TimeRange) (sdk.TimestampedMetrics, error) {
 	n.logger.Debug("Query() called", "query", q, "range", r)
-	var result sdk.TimestampedMetrics
+	if n.metrics != nil {
+		defer n.metrics.since(selfMetricQueryDuration, time.Now(), "query", q)
+	}
 
-	// parse the query
-	queryConfig, err := structtag.Parse(q)
+	m, query, err := n.query(q, r)
 	if err != nil {
-		n.logger.Error("parse query failed: %v", err)
+		if n.metrics != nil {
+			n.metrics.add(selfMetricQueryErrors, 1, "query", q)
+		}
 		return nil, err
 	}
-	tags, err := queryConfig.Get("tags")
-	tagsValue := ""
-	if tags != nil {
-		tagsValue = tags.Value()
+
+	switch len(m) {
+	case 0:
+		return sdk.TimestampedMetrics{}, nil
+	case 1:
+		return m[0], nil
+	}
+
+	// nomad-autoscaler only calls Query(), so grouped series have to be merged here
+	return aggregateGroups(m, query.groupAggregation), nil
+}
+
+// query checks that the query returns a single series, or merges its groups into one, before running it. Otherwise a
+// grouped query would only work as long as there is a single group.
+func (n *APMPlugin) query(q string, r sdk.TimeRange) ([]sdk.TimestampedMetrics, *jobQuery, error) {
+	query, err := n.parseQuery(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	if query.groupBy != "" && query.groupAggregation == "" {
+		return nil, nil, newQueryError(queryKeyGroupAggregation, "", "is required with %s, since only a single series is expected", queryKeyGroupBy)
 	}
-	i, e := utils.SplitTags(tagsValue)
-	includeTags := append(n.includeTags, i...)
-	excludeTags := append(n.excludeTags, e...)
-	n.logger.Trace("tags", "include", includeTags, "exclude", excludeTags)
 
-	// list jobs
-	ret, err := n.listJobs(context.Background(), 50)
+	m, err := n.QueryMultiple(q, r)
+	return m, query, err
+}
+
+func (n *APMPlugin) QueryMultiple(q string, r sdk.TimeRange) ([]sdk.TimestampedMetrics, error) {
+	n.logger.Debug("QueryMultiple() called", "query", q, "range", r)
+
+	// parse the query
+	query, err := n.parseQuery(q)
 	if err != nil {
-		n.logger.Error("listJobs failed: %v", err)
+		n.logger.Error("parse query failed", "error", err)
 		return nil, err
 	}
+	n.logger.Trace("query parsed", "instances", query.instances, "tags", query.tags, "projects", query.projects, "sources", query.sources, "names", query.names, "refs", query.refs, "stages", query.stages, "metric", query.metric, "group_by", query.groupBy, "scope", query.scope)
 
-	// parse jobs into a time series
-	for now := r.From; now.Compare(r.To) <= 0; now = now.Add(n.sampleInterval) {
-		readyJobs := 0
-		runningJobs := 0
-		pendingJobs := 0
-		for _, j := range ret.Jobs.Nodes {
-			// tag filter
-			if ((len(includeTags) > 0) && !utils.MatchAny(j.Tags, includeTags)) || utils.MatchAny(j.Tags, excludeTags) {
-				continue
-			}
+	// list jobs and runners; the demand of multiple instances sharing a runner pool is summed up
+	var jobs []jobNode
+	var runners []runnerNode
+	notBefore := r.From.Add(-query.lookbehind())
+	for _, name := range query.instances {
+		g, ok := n.instances[name]
+		if !ok {
+			// SetConfig failed
+			return nil, fmt.Errorf("instance %s is not configured", name)
+		}
+		scope := g.scope
+		if query.scope != nil {
+			scope = *query.scope
+		}
 
-			// state replay
-			// pending
-			if (j.FinishedAt == time.Time{}) {
-				pendingJobs++
-				continue
-			}
-			startedAt := j.FinishedAt.Add(-time.Second * time.Duration(j.Duration))
-			// running: (startedAt <= now < finishedAt)
-			if (now.Compare(startedAt) >= 0) && (now.Compare(j.FinishedAt) < 0) {
-				runningJobs++
-				continue
-			}
-			// ready: (createdAt <= now < startedAt)
-			if (now.Compare(j.CreatedAt) >= 0) && (now.Compare(startedAt) < 0) {
-				readyJobs++
-				continue
+		instanceJobs, cached, err := g.getJobs(scope, notBefore, query.upcoming())
+		if err != nil {
+			n.logger.Error("listJobs failed", "instance", name, "error", err)
+			return nil, err
+		}
+		n.logger.Trace("jobs listed", "instance", name, "count", len(instanceJobs), "cached", cached)
+		n.recordListing(name, "jobs", cached)
+		n.recordJobsListed(name, instanceJobs)
+
+		var instanceRunners []runnerNode
+		if slices.Contains(runnerMetrics, query.metric) {
+			instanceRunners, cached, err = g.getRunners(scope)
+			if err != nil {
+				n.logger.Error("listRunners failed", "instance", name, "error", err)
+				return nil, err
 			}
+			n.logger.Trace("runners listed", "instance", name, "count", len(instanceRunners), "cached", cached)
+			n.recordListing(name, "runners", cached)
 		}
 
-		n.logger.Trace("time series point", "time", now, "runningJobs", runningJobs, "readyJobs", readyJobs, "pendingJobs", pendingJobs)
-		result = append(result, sdk.TimestampedMetric{
-			Timestamp: now,
-			Value:     float64(readyJobs + runningJobs + pendingJobs),
-		})
+		if len(query.instances) > 1 {
+			instanceJobs, instanceRunners = g.qualifyIds(instanceJobs, instanceRunners)
+		}
+		jobs = append(jobs, instanceJobs...)
+		runners = append(runners, instanceRunners...)
+	}
+
+	var capacity *runnerCapacity
+	if slices.Contains(runnerMetrics, query.metric) {
+		capacity = newRunnerCapacity(runners, jobs, query)
+		n.logger.Trace("runner capacity", "runners", len(capacity.runners), "concurrency", capacity.concurrency)
+	}
+
+	// job filter; the job list might be shared with other queries, so filter a copy of it
+	listed := len(jobs)
+	jobs = slices.DeleteFunc(slices.Clone(jobs), func(j jobNode) bool {
+		return !query.matchJob(j)
+	})
+	n.metrics.add(selfMetricJobsFiltered, float64(listed-len(jobs)), "query", q)
+
+	// group jobs
+	groups := query.groupJobs(jobs)
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	// parse jobs into time series
+	var result []sdk.TimestampedMetrics
+	for _, key := range keys {
+		n.logger.Trace("building time series", "group_by", query.groupBy, "group", key, "jobs", len(groups[key]))
+		result = append(result, n.timeSeries(groups[key], query, capacity, r))
 	}
 
-	n.logger.Debug("Query() returning", "last_result", result[len(result)-1].Value)
-	n.logger.Trace("Query() returning", "result", result)
+	n.logger.Trace("QueryMultiple() returning", "groups", keys, "result", result)
 	return result, nil
 }
+
+// recordListing counts a job or runner listing, by whether it is served from the cache or the webhook job table.
+func (n *APMPlugin) recordListing(instance string, listing string, cached bool) {
+	result := "miss"
+	if cached {
+		result = "hit"
+	}
+	n.metrics.add(selfMetricCacheRequests, 1, selfMetricLabelInstance, instance, "listing", listing, "result", result)
+}
+
+// recordJobsListed sets the number of jobs in the last listing of an instance by status.
+func (n *APMPlugin) recordJobsListed(instance string, jobs []jobNode) {
+	counts := make(map[string]int)
+	for _, j := range jobs {
+		counts[j.Status]++
+	}
+
+	for _, statuses := range [][]CiJobStatus{activeJobStatuses, upcomingJobStatuses, finishedJobStatuses} {
+		for _, status := range statuses {
+			n.metrics.set(selfMetricJobsListed, float64(counts[string(status)]), selfMetricLabelInstance, instance, "status", string(status))
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package gitlab_ci
+
+import (
+	"fmt"
+	"github.com/Jamesits/nomad-autoscaler-plugins/pkg/utils"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	prioritySelectorSource = "source:"
+	prioritySelectorRef    = "ref:"
+	// matches every job, as a fallback at the end of the list
+	prioritySelectorAny = "*"
+	// joins the conditions of a selector
+	prioritySelectorAnd = "&"
+
+	// the class of the jobs matching no rule
+	defaultPriorityClass = "default"
+)
+
+// priorityRule puts the jobs matching all its conditions into a priority class.
+type priorityRule struct {
+	selector string
+	sources  []*utils.Filter
+	refs     []*utils.Filter
+	class    string
+}
+
+// parsePriorityRules parses a comma separated list of `<selector>=<class>` rules, e.g.
+// `source:merge_request_event=interactive, source:schedule=batch`. A selector is one or more conditions joined by `&`,
+// each either `source:<term>` matching the pipeline source or `ref:<term>` matching the ref name, or `*` matching every
+// job; terms are in the same format as the job filters.
+func parsePriorityRules(src string) ([]priorityRule, error) {
+	var ret []priorityRule
+
+	for _, rule := range strings.Split(src, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid priority rule %q, must be <selector>=<class>", rule)
+		}
+
+		r := priorityRule{selector: strings.TrimSpace(rule[:i]), class: strings.TrimSpace(rule[i+1:])}
+		if err := validatePriorityClass(r.class); err != nil {
+			return nil, fmt.Errorf("invalid priority rule %q: %w", rule, err)
+		}
+
+		if r.selector != prioritySelectorAny {
+			for _, condition := range strings.Split(r.selector, prioritySelectorAnd) {
+				condition = strings.TrimSpace(condition)
+
+				var f *utils.Filter
+				var err error
+				switch {
+				case strings.HasPrefix(condition, prioritySelectorSource):
+					f, err = utils.ParseFilter(strings.TrimPrefix(condition, prioritySelectorSource))
+					r.sources = append(r.sources, f)
+				case strings.HasPrefix(condition, prioritySelectorRef):
+					f, err = utils.ParseFilter(strings.TrimPrefix(condition, prioritySelectorRef))
+					r.refs = append(r.refs, f)
+				default:
+					return nil, fmt.Errorf("invalid priority rule %q, the selector must be %s, or conditions %s<term> or %s<term> joined by %s", rule, prioritySelectorAny, prioritySelectorSource, prioritySelectorRef, prioritySelectorAnd)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("invalid priority rule %q: %w", rule, err)
+				}
+			}
+		}
+
+		ret = append(ret, r)
+	}
+
+	return ret, nil
+}
+
+// parsePriorityWeights parses a comma separated list of `<class>=<weight>` pairs, e.g. `interactive=1, batch=0.25`.
+func parsePriorityWeights(src string) (map[string]float64, error) {
+	ret := make(map[string]float64)
+
+	for _, pair := range strings.Split(src, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		class, weight, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid priority weight %q, must be <class>=<weight>", pair)
+		}
+
+		class = strings.TrimSpace(class)
+		if err := validatePriorityClass(class); err != nil {
+			return nil, fmt.Errorf("invalid priority weight %q: %w", pair, err)
+		}
+		if _, ok := ret[class]; ok {
+			return nil, fmt.Errorf("invalid priority weight %q, class %s is already weighted", pair, class)
+		}
+
+		w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if err != nil || math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+			return nil, fmt.Errorf("invalid priority weight %q, the weight must be a finite non-negative number", pair)
+		}
+		ret[class] = w
+	}
+
+	return ret, nil
+}
+
+func validatePriorityClass(class string) error {
+	if class == "" || strings.ContainsAny(class, " \t,=&") {
+		return fmt.Errorf("the class must be a non-empty name without spaces, commas, = or &")
+	}
+	return nil
+}
+
+func (r *priorityRule) match(j jobNode) bool {
+	for _, f := range r.sources {
+		if !f.Match([]string{j.Pipeline.Source}) {
+			return false
+		}
+	}
+	for _, f := range r.refs {
+		if !f.Match([]string{j.RefName}) {
+			return false
+		}
+	}
+	return true
+}
+
+// priorityClass returns the class of the first rule matching the job, or the default class if there is none.
+func (q *jobQuery) priorityClass(j jobNode) string {
+	for _, r := range q.priorityRules {
+		if r.match(j) {
+			return r.class
+		}
+	}
+
+	return defaultPriorityClass
+}
+
+// priorityWeight returns the weight of the job's priority class, or 1 if it is not weighted.
+func (q *jobQuery) priorityWeight(j jobNode) float64 {
+	if w, ok := q.priorityWeights[q.priorityClass(j)]; ok {
+		return w
+	}
+
+	return 1
+}
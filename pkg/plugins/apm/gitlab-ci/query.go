@@ -0,0 +1,463 @@
+package gitlab_ci
+
+import (
+	"fmt"
+	"github.com/Jamesits/nomad-autoscaler-plugins/pkg/utils"
+	"github.com/fatih/structtag"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	queryKeyTags              = "tags"
+	queryKeyProjects          = "projects"
+	queryKeySources           = "sources"
+	queryKeyNames             = "names"
+	queryKeyRefs              = "refs"
+	queryKeyStages            = "stages"
+	queryKeyProject           = "project"
+	queryKeyGroup             = "group"
+	queryKeyMetric            = "metric"
+	queryKeyGroupBy           = "group_by"
+	queryKeyGroupAggregation  = "group_aggregation"
+	queryKeyRunnerConcurrency = "runner_concurrency"
+	queryKeyExcludeStuck      = "exclude_stuck"
+	queryKeyMaxPendingAge     = "max_pending_age_secs"
+	queryKeyLatencyWindow     = "latency_window_secs"
+	queryKeyAggregation       = "aggregation"
+	queryKeySampleAlign       = "sample_align"
+	queryKeyInstance          = "instance"
+	queryKeyWeights           = "weights"
+	queryKeyForecastDiscount  = "forecast_discount"
+	queryKeyPriorities        = "priorities"
+
+	// jobs that are waiting for a runner
+	metricPending = "pending"
+	// alias of metricPending, kept for compatibility
+	metricReady = "ready"
+	// jobs that are running
+	metricRunning = "running"
+	// jobs that are not finished yet, i.e. pending + running
+	metricTotal = "total"
+	// pending jobs that GitLab marks as stuck, i.e. no runner can pick them up
+	metricStuck = "stuck"
+	// pending jobs that are excluded from the pending count by exclude_stuck or max_pending_age_secs
+	metricExcluded = "excluded"
+	// jobs that are waiting for the previous pipeline stages or a resource group
+	metricUpcoming = "upcoming"
+	// total + upcoming * forecast_discount
+	metricForecast = "forecast"
+
+	// average time-to-pickup
+	metricWaitAvg = "wait_avg"
+	// maximum time-to-pickup
+	metricWaitMax = "wait_max"
+	// time-to-pickup percentile, written as e.g. "wait_p90" in the query
+	metricWaitPercentile = "wait_p"
+
+	// online runners that are not paused
+	metricRunnersOnline = "runners_online"
+	// runners that are running at least one job
+	metricRunnersBusy = "runners_busy"
+	// job slots provided by the runners
+	metricRunnerSlots = "runner_slots"
+	// job slots that are not used
+	metricRunnerSlotsIdle = "runner_slots_idle"
+	// jobs waiting for a runner divided by idle job slots
+	metricJobsPerIdleSlot = "jobs_per_idle_slot"
+)
+
+const (
+	// one series per runner tag; a job with multiple tags is counted in every one of them
+	groupByTag = "tag"
+	// one series per project full path
+	groupByProject = "project"
+	// one series per priority class
+	groupByPriority = "priority"
+)
+
+const (
+	// the state at each sample point
+	aggregationInstant = "instant"
+	// the maximum in the bucket
+	aggregationMax = "max"
+	// the time-weighted average in the bucket
+	aggregationAvg = "avg"
+	// job-seconds in the bucket
+	aggregationIntegral = "integral"
+)
+
+const (
+	groupAggregationMax = "max"
+	groupAggregationMin = "min"
+	groupAggregationSum = "sum"
+	groupAggregationAvg = "avg"
+)
+
+var (
+	runnerMetrics         = []string{metricRunnersOnline, metricRunnersBusy, metricRunnerSlots, metricRunnerSlotsIdle, metricJobsPerIdleSlot}
+	supportedMetrics      = append([]string{metricPending, metricReady, metricRunning, metricTotal, metricStuck, metricExcluded, metricUpcoming, metricForecast, metricWaitAvg, metricWaitMax, metricWaitPercentile + "<percentile>"}, runnerMetrics...)
+	supportedGroupBy      = []string{groupByTag, groupByProject, groupByPriority}
+	supportedAggregations = []string{aggregationInstant, aggregationMax, aggregationAvg, aggregationIntegral}
+	// metrics that support bucket aggregations
+	jobCountMetrics            = []string{metricPending, metricReady, metricRunning, metricTotal, metricStuck, metricExcluded, metricUpcoming, metricForecast}
+	supportedGroupAggregations = []string{groupAggregationMax, groupAggregationMin, groupAggregationSum, groupAggregationAvg}
+	supportedQueryKeys         = []string{
+		queryKeyTags, queryKeyProjects, queryKeySources, queryKeyNames, queryKeyRefs, queryKeyStages, queryKeyProject,
+		queryKeyGroup, queryKeyMetric, queryKeyGroupBy, queryKeyGroupAggregation, queryKeyRunnerConcurrency,
+		queryKeyExcludeStuck, queryKeyMaxPendingAge, queryKeyLatencyWindow, queryKeyAggregation, queryKeySampleAlign,
+		queryKeyInstance, queryKeyWeights, queryKeyForecastDiscount, queryKeyPriorities,
+	}
+)
+
+// QueryError is an invalid query string. Key is the query key at fault, or empty if the query cannot be parsed at all.
+type QueryError struct {
+	Key   string
+	Value string
+	Err   error
+}
+
+func newQueryError(key string, value string, format string, args ...any) *QueryError {
+	return &QueryError{Key: key, Value: value, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *QueryError) Error() string {
+	switch {
+	case e.Key == "":
+		return fmt.Sprintf("invalid query: %v", e.Err)
+	case e.Value == "":
+		return fmt.Sprintf("invalid query key %s: %v", e.Key, e.Err)
+	default:
+		return fmt.Sprintf("invalid query key %s %q: %v", e.Key, e.Value, e.Err)
+	}
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// jobQuery is a parsed APM query string.
+type jobQuery struct {
+	// the instances to list jobs from; the jobs of multiple instances are counted together
+	instances []string
+	// replaces the instances' own scope if set
+	scope *jobScope
+	// job filters
+	tags     *utils.Filter
+	projects *utils.Filter
+	sources  *utils.Filter
+	names    *utils.Filter
+	refs     *utils.Filter
+	stages   *utils.Filter
+	// priority class filter
+	priorities *utils.Filter
+
+	metric  string
+	groupBy string
+	// how Query() merges the grouped series into one
+	groupAggregation string
+	// job slots per runner
+	runnerConcurrency int
+	// pending jobs that are stuck are not counted
+	excludeStuck bool
+	// pending jobs older than this are not counted, 0 to count all of them
+	maxPendingAge time.Duration
+	// time-to-pickup metrics are calculated from the jobs started in this window before every sample
+	latencyWindow time.Duration
+	// (0, 100], only used by metricWaitPercentile
+	latencyPercentile float64
+	// how job counts are aggregated in each sample bucket
+	aggregation string
+	// align the sample points to wall clock
+	sampleAlign bool
+	// job weights, only used by job count metrics
+	weights []jobWeight
+	// how much an upcoming job counts, only used by metricForecast
+	forecastDiscount float64
+	// rules putting jobs into priority classes, and the weights of the classes
+	priorityRules   []priorityRule
+	priorityWeights map[string]float64
+}
+
+func (n *APMPlugin) parseQuery(q string) (*jobQuery, error) {
+	queryConfig, err := structtag.Parse(q)
+	if err != nil {
+		return nil, &QueryError{Err: err}
+	}
+
+	for _, key := range queryConfig.Keys() {
+		if !slices.Contains(supportedQueryKeys, key) {
+			return nil, newQueryError(key, "", "not supported, must be one of %v", supportedQueryKeys)
+		}
+	}
+
+	ret := &jobQuery{
+		tags:      n.tags,
+		metric:    metricTotal,
+		instances: []string{defaultInstanceName},
+
+		runnerConcurrency: n.runnerConcurrency,
+		excludeStuck:      n.excludeStuck,
+		maxPendingAge:     n.maxPendingAge,
+		latencyWindow:     n.latencyWindow,
+		aggregation:       n.aggregation,
+		sampleAlign:       n.sampleAlign,
+		weights:           n.weights,
+		forecastDiscount:  n.forecastDiscount,
+		priorityRules:     n.priorityRules,
+		priorityWeights:   n.priorityWeights,
+	}
+
+	// a scope in the query replaces the instances' one entirely
+	project, _ := queryConfig.Get(queryKeyProject)
+	group, _ := queryConfig.Get(queryKeyGroup)
+	if project != nil && group != nil {
+		return nil, newQueryError(queryKeyGroup, group.Value(), "cannot be set at the same time as %s", queryKeyProject)
+	}
+	if project != nil {
+		ret.scope = &jobScope{project: project.Value()}
+	}
+	if group != nil {
+		ret.scope = &jobScope{group: group.Value()}
+	}
+
+	if instance, _ := queryConfig.Get(queryKeyInstance); instance != nil {
+		ret.instances = nil
+		for _, name := range strings.Split(instance.Value(), ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := n.instances[name]; !ok {
+				return nil, newQueryError(queryKeyInstance, instance.Value(), "unknown instance %q", name)
+			}
+			if !slices.Contains(ret.instances, name) {
+				ret.instances = append(ret.instances, name)
+			}
+		}
+	}
+
+	// the query's tag filter is added to the global one
+	if tags, _ := queryConfig.Get(queryKeyTags); tags != nil {
+		f, err := utils.ParseFilter(tags.Value())
+		if err != nil {
+			return nil, newQueryError(queryKeyTags, tags.Value(), "%v", err)
+		}
+		ret.tags = ret.tags.Merge(f)
+	}
+
+	for key, filter := range map[string]**utils.Filter{
+		queryKeyProjects:   &ret.projects,
+		queryKeySources:    &ret.sources,
+		queryKeyNames:      &ret.names,
+		queryKeyRefs:       &ret.refs,
+		queryKeyStages:     &ret.stages,
+		queryKeyPriorities: &ret.priorities,
+	} {
+		*filter = &utils.Filter{}
+		if v, _ := queryConfig.Get(key); v != nil {
+			*filter, err = utils.ParseFilter(v.Value())
+			if err != nil {
+				return nil, newQueryError(key, v.Value(), "%v", err)
+			}
+		}
+	}
+
+	if metric, _ := queryConfig.Get(queryKeyMetric); metric != nil {
+		ret.metric = metric.Value()
+		if p, ok := strings.CutPrefix(ret.metric, metricWaitPercentile); ok {
+			ret.metric = metricWaitPercentile
+			ret.latencyPercentile, err = strconv.ParseFloat(p, 64)
+			if err != nil || math.IsNaN(ret.latencyPercentile) || math.IsInf(ret.latencyPercentile, 0) || ret.latencyPercentile <= 0 || ret.latencyPercentile > 100 {
+				return nil, newQueryError(queryKeyMetric, metric.Value(), "the percentile must be in (0, 100]")
+			}
+		} else if !slices.Contains(supportedMetrics, ret.metric) {
+			return nil, newQueryError(queryKeyMetric, metric.Value(), "must be one of %v", supportedMetrics)
+		}
+	}
+
+	if groupBy, _ := queryConfig.Get(queryKeyGroupBy); groupBy != nil {
+		ret.groupBy = groupBy.Value()
+		if !slices.Contains(supportedGroupBy, ret.groupBy) {
+			return nil, newQueryError(queryKeyGroupBy, groupBy.Value(), "must be one of %v", supportedGroupBy)
+		}
+	}
+
+	if groupAggregation, _ := queryConfig.Get(queryKeyGroupAggregation); groupAggregation != nil {
+		ret.groupAggregation = groupAggregation.Value()
+		if !slices.Contains(supportedGroupAggregations, ret.groupAggregation) {
+			return nil, newQueryError(queryKeyGroupAggregation, groupAggregation.Value(), "must be one of %v", supportedGroupAggregations)
+		}
+	}
+
+	if runnerConcurrency, _ := queryConfig.Get(queryKeyRunnerConcurrency); runnerConcurrency != nil {
+		l, err := strconv.ParseInt(runnerConcurrency.Value(), 10, 64)
+		if err != nil || l <= 0 {
+			return nil, newQueryError(queryKeyRunnerConcurrency, runnerConcurrency.Value(), "must be a positive integer")
+		}
+		ret.runnerConcurrency = int(l)
+	}
+
+	if excludeStuck, _ := queryConfig.Get(queryKeyExcludeStuck); excludeStuck != nil {
+		ret.excludeStuck, err = strconv.ParseBool(excludeStuck.Value())
+		if err != nil {
+			return nil, newQueryError(queryKeyExcludeStuck, excludeStuck.Value(), "must be a boolean")
+		}
+	}
+
+	if maxPendingAge, _ := queryConfig.Get(queryKeyMaxPendingAge); maxPendingAge != nil {
+		l, err := strconv.ParseInt(maxPendingAge.Value(), 10, 64)
+		if err != nil || l < 0 {
+			return nil, newQueryError(queryKeyMaxPendingAge, maxPendingAge.Value(), "must be a non-negative integer")
+		}
+		ret.maxPendingAge = time.Second * time.Duration(l)
+	}
+
+	if latencyWindow, _ := queryConfig.Get(queryKeyLatencyWindow); latencyWindow != nil {
+		l, err := strconv.ParseInt(latencyWindow.Value(), 10, 64)
+		if err != nil || l <= 0 {
+			return nil, newQueryError(queryKeyLatencyWindow, latencyWindow.Value(), "must be a positive integer")
+		}
+		ret.latencyWindow = time.Second * time.Duration(l)
+	}
+
+	if aggregation, _ := queryConfig.Get(queryKeyAggregation); aggregation != nil {
+		ret.aggregation = aggregation.Value()
+		if !slices.Contains(supportedAggregations, ret.aggregation) {
+			return nil, newQueryError(queryKeyAggregation, aggregation.Value(), "must be one of %v", supportedAggregations)
+		}
+	}
+	if ret.aggregation != aggregationInstant && !slices.Contains(jobCountMetrics, ret.metric) {
+		return nil, newQueryError(queryKeyAggregation, ret.aggregation, "can only be used with %s %v", queryKeyMetric, jobCountMetrics)
+	}
+
+	if sampleAlign, _ := queryConfig.Get(queryKeySampleAlign); sampleAlign != nil {
+		ret.sampleAlign, err = strconv.ParseBool(sampleAlign.Value())
+		if err != nil {
+			return nil, newQueryError(queryKeySampleAlign, sampleAlign.Value(), "must be a boolean")
+		}
+	}
+
+	if forecastDiscount, _ := queryConfig.Get(queryKeyForecastDiscount); forecastDiscount != nil {
+		ret.forecastDiscount, err = strconv.ParseFloat(forecastDiscount.Value(), 64)
+		if err != nil || math.IsNaN(ret.forecastDiscount) || ret.forecastDiscount < 0 || ret.forecastDiscount > 1 {
+			return nil, newQueryError(queryKeyForecastDiscount, forecastDiscount.Value(), "must be a number in [0, 1]")
+		}
+	}
+
+	// the query's weights replace the global ones entirely, since only the first matching rule counts
+	if weights, _ := queryConfig.Get(queryKeyWeights); weights != nil {
+		ret.weights, err = parseWeights(weights.Value())
+		if err != nil {
+			return nil, newQueryError(queryKeyWeights, weights.Value(), "%v", err)
+		}
+		// the global weights are simply not used by the other metrics
+		if !slices.Contains(jobCountMetrics, ret.metric) {
+			return nil, newQueryError(queryKeyWeights, weights.Value(), "can only be used with %s %v", queryKeyMetric, jobCountMetrics)
+		}
+	}
+
+	if ret.groupBy != "" && slices.Contains(runnerMetrics, ret.metric) {
+		return nil, newQueryError(queryKeyGroupBy, ret.groupBy, "cannot be used with %s %q", queryKeyMetric, ret.metric)
+	}
+
+	return ret, nil
+}
+
+// matchTags tells whether a job or a runner with the tags passes the query's tag filter.
+func (q *jobQuery) matchTags(tags []string) bool {
+	return q.tags.Match(tags)
+}
+
+// matchJob tells whether a job passes all the query's filters.
+func (q *jobQuery) matchJob(j jobNode) bool {
+	return q.matchTags(j.Tags) &&
+		q.projects.Match([]string{j.Project.FullPath}) &&
+		q.sources.Match([]string{j.Pipeline.Source}) &&
+		q.names.Match([]string{j.Name}) &&
+		q.refs.Match([]string{j.RefName}) &&
+		q.stages.Match([]string{j.Stage.Name}) &&
+		q.priorities.Match([]string{q.priorityClass(j)})
+}
+
+// upcoming tells whether the query needs upcoming jobs, which are not listed otherwise.
+func (q *jobQuery) upcoming() bool {
+	return q.metric == metricUpcoming || q.metric == metricForecast
+}
+
+// lookbehind returns how long before the queried time range the jobs are needed.
+func (q *jobQuery) lookbehind() time.Duration {
+	switch q.metric {
+	case metricWaitAvg, metricWaitMax, metricWaitPercentile:
+		return q.latencyWindow
+	default:
+		return 0
+	}
+}
+
+// excludePending tells whether a job pending at the time should be left out of the pending count.
+func (q *jobQuery) excludePending(j jobNode, now time.Time) bool {
+	if q.excludeStuck && j.Stuck {
+		return true
+	}
+
+	return q.maxPendingAge > 0 && now.Sub(j.queuedAt()) > q.maxPendingAge
+}
+
+// groupJobs splits jobs into groups by the query's groupBy key. If groupBy is empty, all the jobs are put into a single
+// group. If there are no groups at all, a single empty group is returned, so that an idle pool reports zeros instead of
+// no data.
+func (q *jobQuery) groupJobs(jobs []jobNode) map[string][]jobNode {
+	groupBy := q.groupBy
+	ret := make(map[string][]jobNode)
+
+	for _, j := range jobs {
+		switch groupBy {
+		case groupByTag:
+			for _, t := range j.Tags {
+				ret[t] = append(ret[t], j)
+			}
+		case groupByProject:
+			ret[j.Project.FullPath] = append(ret[j.Project.FullPath], j)
+		case groupByPriority:
+			class := q.priorityClass(j)
+			ret[class] = append(ret[class], j)
+		default:
+			ret[""] = append(ret[""], j)
+		}
+	}
+
+	if len(ret) == 0 {
+		ret[""] = nil
+	}
+
+	return ret
+}
+
+// aggregateGroups merges multiple time series sampled at the same points into one, point by point.
+func aggregateGroups(series []sdk.TimestampedMetrics, aggregation string) sdk.TimestampedMetrics {
+	if len(series) == 0 {
+		return sdk.TimestampedMetrics{}
+	}
+
+	ret := slices.Clone(series[0])
+	for i := range ret {
+		for _, s := range series[1:] {
+			switch aggregation {
+			case groupAggregationMax:
+				ret[i].Value = max(ret[i].Value, s[i].Value)
+			case groupAggregationMin:
+				ret[i].Value = min(ret[i].Value, s[i].Value)
+			case groupAggregationSum, groupAggregationAvg:
+				ret[i].Value += s[i].Value
+			}
+		}
+
+		if aggregation == groupAggregationAvg {
+			ret[i].Value /= float64(len(series))
+		}
+	}
+
+	return ret
+}
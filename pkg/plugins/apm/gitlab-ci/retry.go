@@ -0,0 +1,183 @@
+package gitlab_ci
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryingHttpTransport retries failed requests with exponential backoff and jitter, and holds requests back while
+// GitLab's rate limit is exhausted. Waits requested by GitLab are capped at maxBackoff: if GitLab asks for a longer
+// one, the request fails right away instead of blocking the query.
+type retryingHttpTransport struct {
+	logger hclog.Logger
+	next   http.RoundTripper
+
+	// timeout of a single attempt
+	timeout    time.Duration
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	lock sync.Mutex
+	// no request is sent before this time, as told by RateLimit-* headers
+	rateLimitedUntil time.Time
+}
+
+// cancelOnCloseBody cancels the context of a single attempt when the response body is closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func (t *retryingHttpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		t.lock.Lock()
+		wait := time.Until(t.rateLimitedUntil)
+		t.lock.Unlock()
+		if wait > t.maxBackoff {
+			return nil, fmt.Errorf("GitLab rate limit exhausted for %s, longer than retry_max_backoff_ms", wait.Round(time.Second))
+		}
+		if wait > 0 {
+			t.logger.Debug("rate limit exhausted, waiting", "wait", wait)
+			if err := sleepWithContext(req.Context(), wait); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.roundTripOnce(req, attempt)
+		if err != nil && req.Context().Err() != nil {
+			// canceled by the caller
+			return nil, err
+		}
+
+		retryable := err != nil || isRetryableStatus(resp.StatusCode)
+		if !retryable || attempt >= t.maxRetries {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				if d > t.maxBackoff {
+					t.logger.Warn("request failed, not retrying since Retry-After is longer than retry_max_backoff_ms", "status", resp.Status, "retry_after", d)
+					return resp, nil
+				}
+				delay = d
+			}
+			t.logger.Warn("request failed, retrying", "status", resp.Status, "attempt", attempt+1, "delay", delay)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		} else {
+			t.logger.Warn("request failed, retrying", "error", err, "attempt", attempt+1, "delay", delay)
+		}
+
+		if err := sleepWithContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *retryingHttpTransport) roundTripOnce(req *http.Request, attempt int) (*http.Response, error) {
+	if attempt > 0 && req.Body != nil {
+		if req.GetBody == nil {
+			return nil, http.ErrBodyNotAllowed
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	t.observeRateLimit(resp.Header)
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// observeRateLimit remembers when the rate limit resets if there is no request left.
+// See: https://docs.gitlab.com/ee/administration/settings/user_and_ip_rate_limits.html#response-headers
+func (t *retryingHttpTransport) observeRateLimit(header http.Header) {
+	remaining, err := strconv.ParseInt(header.Get("RateLimit-Remaining"), 10, 64)
+	if err != nil || remaining > 0 {
+		return
+	}
+
+	reset, err := strconv.ParseInt(header.Get("RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	t.lock.Lock()
+	t.rateLimitedUntil = time.Unix(reset, 0)
+	t.lock.Unlock()
+}
+
+// backoff returns a random delay between 0 and the exponential backoff of the attempt ("full jitter").
+func (t *retryingHttpTransport) backoff(attempt int) time.Duration {
+	d := t.maxBackoff
+	if attempt < 32 {
+		d = min(t.minBackoff<<attempt, t.maxBackoff)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either in seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Second * time.Duration(max(secs, 0)), true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+
+	return 0, false
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,81 @@
+package gitlab_ci
+
+import (
+	"context"
+	"fmt"
+	"github.com/hasura/go-graphql-client"
+)
+
+type runnerNode struct {
+	ID      string   `graphql:"id"`
+	Status  string   `graphql:"status"`
+	Paused  bool     `graphql:"paused"`
+	TagList []string `graphql:"tagList"`
+}
+
+type runnerConnection struct {
+	Nodes    []runnerNode `graphql:"nodes"`
+	PageInfo pageInfo     `graphql:"pageInfo"`
+}
+
+type queryGetAllRunners struct {
+	Runners runnerConnection `graphql:"runners(first: $first, after: $after, status: ONLINE, paused: false)"`
+}
+
+type queryGetGroupRunners struct {
+	Group *struct {
+		Runners runnerConnection `graphql:"runners(first: $first, after: $after, status: ONLINE, paused: false)"`
+	} `graphql:"group(fullPath: $fullPath)"`
+}
+
+// listRunners lists every online runner that is not paused in the scope.
+//
+// Runners can only be listed instance-wide (which requires an administrator token) or by group; there is no way to list
+// the runners available to a single project.
+func (g *gitlabInstance) listRunners(ctx context.Context, scope jobScope) ([]runnerNode, error) {
+	if scope.project != "" {
+		return nil, fmt.Errorf("runners cannot be listed in a project scope, use a group scope instead")
+	}
+
+	var ret []runnerNode
+	var after *string
+
+	for {
+		first := maxPageSize
+		variables := map[string]interface{}{
+			"first": &first,
+			"after": after,
+		}
+
+		var runners *runnerConnection
+		if scope.group == "" {
+			q := &queryGetAllRunners{}
+			if err := g.query(ctx, "getAllRunners", q, variables); err != nil {
+				return nil, err
+			}
+			runners = &q.Runners
+		} else {
+			q := &queryGetGroupRunners{}
+			variables["fullPath"] = graphql.ID(scope.group)
+			if err := g.query(ctx, "getGroupRunners", q, variables); err != nil {
+				return nil, err
+			}
+			if q.Group == nil {
+				return nil, notFoundError("group", scope.group)
+			}
+			runners = &q.Group.Runners
+		}
+
+		ret = append(ret, runners.Nodes...)
+		g.logger.Trace("runner page received", "group", scope.group, "count", len(runners.Nodes), "total", len(ret))
+
+		if !runners.PageInfo.HasNextPage || len(runners.Nodes) == 0 {
+			break
+		}
+
+		cursor := runners.PageInfo.EndCursor
+		after = &cursor
+	}
+
+	return ret, nil
+}
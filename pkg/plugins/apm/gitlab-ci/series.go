@@ -0,0 +1,410 @@
+package gitlab_ci
+
+import (
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"math"
+	"slices"
+	"time"
+)
+
+// runnerCapacity is the job capacity provided by the runners matching a query.
+type runnerCapacity struct {
+	runners     map[string]struct{}
+	concurrency int
+	// jobs that are assigned to the runners, regardless of the query's tag filter
+	jobs []jobNode
+}
+
+func newRunnerCapacity(runners []runnerNode, jobs []jobNode, query *jobQuery) *runnerCapacity {
+	ret := &runnerCapacity{
+		runners:     make(map[string]struct{}),
+		concurrency: query.runnerConcurrency,
+	}
+
+	for _, r := range runners {
+		if query.matchTags(r.TagList) {
+			ret.runners[r.ID] = struct{}{}
+		}
+	}
+
+	for _, j := range jobs {
+		if _, ok := ret.runners[j.Runner.ID]; ok {
+			ret.jobs = append(ret.jobs, j)
+		}
+	}
+
+	return ret
+}
+
+// usage returns how many runners are busy and how many job slots are used at the time.
+func (c *runnerCapacity) usage(now time.Time) (busyRunners int, usedSlots int) {
+	busy := make(map[string]struct{})
+	for _, j := range c.jobs {
+		if j.stateAt(now) == jobStateRunning {
+			busy[j.Runner.ID] = struct{}{}
+			usedSlots++
+		}
+	}
+
+	return len(busy), min(usedSlots, len(c.runners)*c.concurrency)
+}
+
+type jobState int
+
+const (
+	// the job does not exist yet, or is already finished
+	jobStateNone jobState = iota
+	// the job is waiting for the previous pipeline stages or a resource group
+	jobStateUpcoming
+	// the job is waiting for a runner to pick it up
+	jobStatePending
+	// the job is being run by a runner
+	jobStateRunning
+)
+
+// stateAt rebuilds the job's timeline from its timestamps and tells which state it was in at the time:
+//
+//	createdAt -> upcoming -> queuedAt -> pending -> startedAt -> running -> finishedAt
+//
+// A job that is finished without ever being started stays in its last state until finishedAt: pending if it is canceled
+// while queued, upcoming otherwise. A job that is not finished yet stays in its current state until now.
+func (j jobNode) stateAt(now time.Time) jobState {
+	if now.Before(j.CreatedAt) {
+		return jobStateNone
+	}
+
+	if (j.FinishedAt != time.Time{}) && now.Compare(j.FinishedAt) >= 0 {
+		return jobStateNone
+	}
+
+	if startedAt := j.startedAt(); (startedAt != time.Time{}) && now.Compare(startedAt) >= 0 {
+		return jobStateRunning
+	}
+
+	if queuedAt := j.queuedAt(); (queuedAt == time.Time{}) || now.Before(queuedAt) {
+		return jobStateUpcoming
+	}
+	return jobStatePending
+}
+
+// queuedAt returns when the job is queued for a runner, or zero if it is never queued. Jobs without queuedAt (e.g.
+// from old GitLab versions) are considered queued when they are created, unless they are finished without being
+// started, since they might just as well be canceled while created.
+func (j jobNode) queuedAt() time.Time {
+	if (j.QueuedAt != time.Time{}) {
+		return j.QueuedAt
+	}
+
+	if slices.Contains(upcomingJobStatuses, CiJobStatus(j.Status)) {
+		return time.Time{}
+	}
+
+	if (j.FinishedAt != time.Time{}) && (j.startedAt() == time.Time{}) {
+		return time.Time{}
+	}
+
+	return j.CreatedAt
+}
+
+// startedAt returns when the job is picked up by a runner, or zero if it is never started.
+func (j jobNode) startedAt() time.Time {
+	if (j.StartedAt != time.Time{}) {
+		return j.StartedAt
+	}
+
+	if (j.FinishedAt != time.Time{}) && j.Duration > 0 {
+		// startedAt might be missing on jobs created by very old GitLab versions
+		return j.FinishedAt.Add(-time.Second * time.Duration(j.Duration))
+	}
+
+	if j.Status == "RUNNING" {
+		return j.CreatedAt
+	}
+
+	return time.Time{}
+}
+
+// queueLatency returns the time-to-pickup (startedAt - createdAt) of the jobs in the window ending at the time, in
+// seconds, aggregated by the query's metric. Jobs still pending at the time are counted with how long they have been
+// waiting so far, so that the latency keeps rising when no job is picked up at all.
+func (q *jobQuery) queueLatency(jobs []jobNode, now time.Time) float64 {
+	var waits []float64
+	for _, j := range jobs {
+		startedAt := j.startedAt()
+		switch {
+		case (startedAt != time.Time{}) && startedAt.After(now.Add(-q.latencyWindow)) && !startedAt.After(now):
+			waits = append(waits, startedAt.Sub(j.CreatedAt).Seconds())
+		case j.stateAt(now) == jobStatePending && !q.excludePending(j, now):
+			waits = append(waits, now.Sub(j.CreatedAt).Seconds())
+		}
+	}
+
+	if len(waits) == 0 {
+		return 0
+	}
+
+	switch q.metric {
+	case metricWaitAvg:
+		sum := 0.0
+		for _, w := range waits {
+			sum += w
+		}
+		return sum / float64(len(waits))
+	case metricWaitMax:
+		return slices.Max(waits)
+	default:
+		// nearest-rank percentile
+		slices.Sort(waits)
+		rank := int(math.Ceil(q.latencyPercentile / 100 * float64(len(waits))))
+		rank = min(max(rank, 1), len(waits))
+		return waits[rank-1]
+	}
+}
+
+// timeInterval is a half-open time interval [start, end) in which a job of the weight is counted.
+type timeInterval struct {
+	start  time.Time
+	end    time.Time
+	weight float64
+}
+
+// metricIntervals returns the time intervals in which the job is counted by the query's job count metric. Intervals
+// that are still open are closed at until.
+func (q *jobQuery) metricIntervals(j jobNode, until time.Time) []timeInterval {
+	end := until
+	if (j.FinishedAt != time.Time{}) {
+		end = j.FinishedAt
+	}
+
+	startedAt := j.startedAt()
+	pendingEnd := end
+	if (startedAt != time.Time{}) && startedAt.Before(end) {
+		pendingEnd = startedAt
+	}
+
+	queuedAt := j.queuedAt()
+	if (queuedAt == time.Time{}) || queuedAt.After(pendingEnd) {
+		// still upcoming
+		queuedAt = pendingEnd
+	}
+
+	// the job is upcoming in [createdAt, queuedAt), counted as pending in [queuedAt, cut), and excluded in
+	// [cut, pendingEnd)
+	cut := pendingEnd
+	if q.excludeStuck && j.Stuck {
+		cut = queuedAt
+	} else if q.maxPendingAge > 0 && queuedAt.Add(q.maxPendingAge).Before(pendingEnd) {
+		cut = queuedAt.Add(q.maxPendingAge)
+	}
+
+	weight := q.weight(j)
+	var ret []timeInterval
+	switch q.metric {
+	case metricPending, metricReady:
+		ret = append(ret, timeInterval{queuedAt, cut, weight})
+	case metricExcluded:
+		ret = append(ret, timeInterval{cut, pendingEnd, weight})
+	case metricStuck:
+		if j.Stuck {
+			ret = append(ret, timeInterval{queuedAt, pendingEnd, weight})
+		}
+	case metricUpcoming:
+		ret = append(ret, timeInterval{j.CreatedAt, queuedAt, weight})
+	case metricRunning:
+		if (startedAt != time.Time{}) {
+			ret = append(ret, timeInterval{startedAt, end, weight})
+		}
+	case metricTotal, metricForecast:
+		ret = append(ret, timeInterval{queuedAt, cut, weight})
+		if (startedAt != time.Time{}) {
+			ret = append(ret, timeInterval{startedAt, end, weight})
+		}
+		if q.metric == metricForecast {
+			ret = append(ret, timeInterval{j.CreatedAt, queuedAt, weight * q.forecastDiscount})
+		}
+	}
+
+	return slices.DeleteFunc(ret, func(i timeInterval) bool {
+		return !i.start.Before(i.end)
+	})
+}
+
+// aggregateBucket aggregates the total weight of the intervals overlapping with each instant in the bucket [from, to).
+func aggregateBucket(intervals []timeInterval, from time.Time, to time.Time, aggregation string) float64 {
+	type event struct {
+		at    time.Time
+		delta float64
+	}
+
+	integral := 0.0
+	current := 0.0
+	var events []event
+	for _, i := range intervals {
+		start := maxTime(i.start, from)
+		end := minTime(i.end, to)
+		if !start.Before(end) {
+			continue
+		}
+
+		integral += end.Sub(start).Seconds() * i.weight
+		if start.Equal(from) {
+			current += i.weight
+		} else {
+			events = append(events, event{start, i.weight})
+		}
+		if end.Before(to) {
+			events = append(events, event{end, -i.weight})
+		}
+	}
+
+	switch aggregation {
+	case aggregationIntegral:
+		return integral
+	case aggregationAvg:
+		return integral / to.Sub(from).Seconds()
+	}
+
+	// an interval ending at the same time as another one starts does not overlap with it
+	slices.SortFunc(events, func(a, b event) int {
+		if c := a.at.Compare(b.at); c != 0 {
+			return c
+		}
+		switch {
+		case a.delta < b.delta:
+			return -1
+		case a.delta > b.delta:
+			return 1
+		}
+		return 0
+	})
+
+	peak := current
+	for _, e := range events {
+		current += e.delta
+		peak = max(peak, current)
+	}
+	return peak
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// timeSeries replays the state of the jobs at every sample point in the time range. With a bucket aggregation, each
+// sample aggregates the bucket of one sample interval ending at it instead.
+func (n *APMPlugin) timeSeries(jobs []jobNode, query *jobQuery, capacity *runnerCapacity, r sdk.TimeRange) sdk.TimestampedMetrics {
+	var result sdk.TimestampedMetrics
+
+	from := r.From
+	if query.sampleAlign {
+		// align the samples to multiples of the interval since the Unix epoch, so that repeated queries sample at the
+		// same points; time.Truncate counts from year 1 instead, which differs unless the interval divides a day
+		offset := time.Duration(r.From.UnixNano() % int64(n.sampleInterval))
+		if offset < 0 {
+			offset += n.sampleInterval
+		}
+		from = r.From.Add(-offset)
+		if from.Before(r.From) {
+			from = from.Add(n.sampleInterval)
+		}
+	}
+
+	var intervals []timeInterval
+	if query.aggregation != aggregationInstant {
+		for _, j := range jobs {
+			intervals = append(intervals, query.metricIntervals(j, r.To)...)
+		}
+	}
+
+	for now := from; now.Compare(r.To) <= 0; now = now.Add(n.sampleInterval) {
+		if query.aggregation != aggregationInstant {
+			value := aggregateBucket(intervals, now.Add(-n.sampleInterval), now, query.aggregation)
+			n.logger.Trace("time series bucket", "from", now.Add(-n.sampleInterval), "to", now, "aggregation", query.aggregation, "value", value)
+			result = append(result, sdk.TimestampedMetric{
+				Timestamp: now,
+				Value:     value,
+			})
+			continue
+		}
+
+		// jobs are counted by their weights
+		pendingJobs := 0.0
+		runningJobs := 0.0
+		stuckJobs := 0.0
+		// pending jobs that are not counted as pending
+		excludedJobs := 0.0
+		upcomingJobs := 0.0
+		for _, j := range jobs {
+			switch j.stateAt(now) {
+			case jobStateUpcoming:
+				upcomingJobs += query.weight(j)
+			case jobStatePending:
+				if j.Stuck {
+					stuckJobs += query.weight(j)
+				}
+				if query.excludePending(j, now) {
+					excludedJobs += query.weight(j)
+					continue
+				}
+				pendingJobs += query.weight(j)
+			case jobStateRunning:
+				runningJobs += query.weight(j)
+			}
+		}
+
+		var value float64
+		switch query.metric {
+		case metricWaitAvg, metricWaitMax, metricWaitPercentile:
+			value = query.queueLatency(jobs, now)
+		case metricStuck:
+			value = stuckJobs
+		case metricExcluded:
+			value = excludedJobs
+		case metricPending, metricReady:
+			value = pendingJobs
+		case metricRunning:
+			value = runningJobs
+		case metricTotal:
+			value = pendingJobs + runningJobs
+		case metricUpcoming:
+			value = upcomingJobs
+		case metricForecast:
+			value = pendingJobs + runningJobs + upcomingJobs*query.forecastDiscount
+		default:
+			busyRunners, usedSlots := capacity.usage(now)
+			slots := len(capacity.runners) * capacity.concurrency
+			switch query.metric {
+			case metricRunnersOnline:
+				value = float64(len(capacity.runners))
+			case metricRunnersBusy:
+				value = float64(busyRunners)
+			case metricRunnerSlots:
+				value = float64(slots)
+			case metricRunnerSlotsIdle:
+				value = float64(slots - usedSlots)
+			case metricJobsPerIdleSlot:
+				// avoid dividing by zero when every slot is used
+				value = pendingJobs / float64(max(slots-usedSlots, 1))
+			}
+			n.logger.Trace("runner capacity point", "time", now, "runners", len(capacity.runners), "busyRunners", busyRunners, "slots", slots, "usedSlots", usedSlots)
+		}
+
+		n.logger.Trace("time series point", "time", now, "pendingJobs", pendingJobs, "runningJobs", runningJobs, "stuckJobs", stuckJobs, "excludedJobs", excludedJobs, "upcomingJobs", upcomingJobs, "value", value)
+		result = append(result, sdk.TimestampedMetric{
+			Timestamp: now,
+			Value:     value,
+		})
+	}
+
+	return result
+}
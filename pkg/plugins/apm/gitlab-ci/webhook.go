@@ -0,0 +1,413 @@
+package gitlab_ci
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hasura/go-graphql-client"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookEventJob = "Job Hook"
+
+	// how long a job event takes at most to be handled
+	webhookJobFetchTimeout = 30 * time.Second
+)
+
+type JobID string
+
+func (_ JobID) GetGraphQLType() string { return "JobID" }
+
+type queryGetProjectJob struct {
+	Project *struct {
+		Job *jobNode `graphql:"job(id: $id)"`
+	} `graphql:"project(fullPath: $fullPath)"`
+}
+
+// gitlabTime is a timestamp in a webhook payload, which is either RFC 3339 or "2006-01-02 15:04:05 UTC" depending on
+// the GitLab version.
+type gitlabTime time.Time
+
+func (t *gitlabTime) UnmarshalJSON(b []byte) error {
+	var s *string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s == nil || *s == "" {
+		*t = gitlabTime{}
+		return nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05 MST", "2006-01-02 15:04:05 -0700"} {
+		if parsed, err := time.Parse(layout, *s); err == nil {
+			*t = gitlabTime(parsed)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown time format: %s", *s)
+}
+
+// jobEvent is the payload of a job webhook event.
+// See: https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#job-events
+type jobEvent struct {
+	ObjectKind      string     `json:"object_kind"`
+	Ref             string     `json:"ref"`
+	BuildId         int64      `json:"build_id"`
+	BuildName       string     `json:"build_name"`
+	BuildStage      string     `json:"build_stage"`
+	BuildStatus     string     `json:"build_status"`
+	BuildCreatedAt  gitlabTime `json:"build_created_at"`
+	BuildStartedAt  gitlabTime `json:"build_started_at"`
+	BuildFinishedAt gitlabTime `json:"build_finished_at"`
+	BuildDuration   *float64   `json:"build_duration"`
+	Runner          *struct {
+		Id int64 `json:"id"`
+	} `json:"runner"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
+func (e *jobEvent) jobId() string {
+	return fmt.Sprintf("gid://gitlab/Ci::Build/%d", e.BuildId)
+}
+
+// apply updates the job's state from the event.
+func (e *jobEvent) apply(j *jobNode) {
+	j.ID = e.jobId()
+	j.Status = strings.ToUpper(e.BuildStatus)
+	j.CreatedAt = time.Time(e.BuildCreatedAt)
+	if j.Status == "PENDING" && (j.QueuedAt == time.Time{}) {
+		// job events do not tell when the job is queued, but the event arrives about then
+		j.QueuedAt = time.Now()
+	}
+	j.StartedAt = time.Time(e.BuildStartedAt)
+	j.FinishedAt = time.Time(e.BuildFinishedAt)
+	if e.BuildDuration != nil {
+		j.Duration = uint(*e.BuildDuration)
+	}
+	if e.Runner != nil {
+		j.Runner.ID = fmt.Sprintf("gid://gitlab/Ci::Runner/%d", e.Runner.Id)
+	}
+	j.Name = e.BuildName
+	j.RefName = e.Ref
+	j.Stage.Name = e.BuildStage
+	j.Project.FullPath = e.Project.PathWithNamespace
+	if j.Status != "PENDING" {
+		j.Stuck = false
+	}
+}
+
+type jobTableEntry struct {
+	job       jobNode
+	updatedAt time.Time
+}
+
+type jobTableReconciliation struct {
+	at        time.Time
+	notBefore time.Time
+}
+
+// inflightReconciliation is a reconciliation that is still running, which other callers can wait for.
+type inflightReconciliation struct {
+	done      chan struct{}
+	notBefore time.Time
+	err       error
+}
+
+// jobTable is the state of the jobs kept up to date by webhook events. Since webhook events can be missed (e.g. while
+// nomad-autoscaler is not running), the jobs in a scope are periodically reconciled with the jobs listed from the API.
+type jobTable struct {
+	logger            hclog.Logger
+	reconcileInterval time.Duration
+	retention         time.Duration
+	// how long past reconcileInterval the table is still served if reconciling it fails
+	maxStale time.Duration
+
+	lock       sync.Mutex
+	jobs       map[string]*jobTableEntry
+	reconciled map[string]jobTableReconciliation
+	inflight   map[string]*inflightReconciliation
+}
+
+func newJobTable(logger hclog.Logger, reconcileInterval time.Duration, retention time.Duration, maxStale time.Duration) *jobTable {
+	return &jobTable{
+		logger:            logger,
+		reconcileInterval: reconcileInterval,
+		retention:         retention,
+		maxStale:          maxStale,
+		jobs:              make(map[string]*jobTableEntry),
+		reconciled:        make(map[string]jobTableReconciliation),
+		inflight:          make(map[string]*inflightReconciliation),
+	}
+}
+
+// get returns the jobs in the scope, reconciling them with fetch first if they have not been reconciled for a while,
+// or if the reconciled jobs do not cover the time range starting at notBefore. Concurrent callers of the same scope
+// share a single reconciliation. If reconciling fails, the jobs are still served from webhook events for up to
+// maxStale past the due reconciliation.
+func (t *jobTable) get(scope jobScope, notBefore time.Time, fetch func() ([]jobNode, error)) ([]jobNode, bool, error) {
+	key := scope.String()
+	t.lock.Lock()
+
+	if r, ok := t.reconciled[key]; ok && time.Since(r.at) < t.reconcileInterval && !notBefore.Before(r.notBefore) {
+		t.lock.Unlock()
+		return t.snapshot(scope), true, nil
+	}
+
+	if f, ok := t.inflight[key]; ok && !notBefore.Before(f.notBefore) {
+		t.lock.Unlock()
+		<-f.done
+		if f.err != nil {
+			return nil, true, f.err
+		}
+		return t.snapshot(scope), true, nil
+	}
+
+	f := &inflightReconciliation{
+		done:      make(chan struct{}),
+		notBefore: notBefore,
+	}
+	t.inflight[key] = f
+	t.lock.Unlock()
+
+	start := time.Now()
+	jobs, err := fetch()
+
+	t.lock.Lock()
+	r, ok := t.reconciled[key]
+	t.lock.Unlock()
+	switch {
+	case err == nil:
+		t.reconcile(scope, jobs, start, notBefore)
+	case ok && time.Since(r.at) < t.reconcileInterval+t.maxStale && !notBefore.Before(r.notBefore):
+		t.logger.Warn("reconciling job table failed, serving jobs from webhook events only", "scope", scope, "age", time.Since(r.at), "error", err)
+	default:
+		f.err = err
+	}
+
+	t.lock.Lock()
+	if t.inflight[key] == f {
+		delete(t.inflight, key)
+	}
+	t.lock.Unlock()
+	close(f.done)
+
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	return t.snapshot(scope), false, nil
+}
+
+// reconcile replaces the jobs in the scope with the jobs listed from the API at start, except for those updated by
+// webhook events since then.
+func (t *jobTable) reconcile(scope jobScope, jobs []jobNode, start time.Time, notBefore time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	listed := make(map[string]struct{})
+	for _, j := range jobs {
+		listed[j.ID] = struct{}{}
+		if e, ok := t.jobs[j.ID]; ok && e.updatedAt.After(start) {
+			continue
+		}
+		t.jobs[j.ID] = &jobTableEntry{job: j, updatedAt: start}
+	}
+
+	removed := 0
+	for id, e := range t.jobs {
+		if _, ok := listed[id]; !ok && scope.contains(e.job) && e.updatedAt.Before(start) {
+			// finished long ago, or an event is missed
+			delete(t.jobs, id)
+			removed++
+		}
+	}
+
+	t.reconciled[scope.String()] = jobTableReconciliation{at: start, notBefore: notBefore}
+	t.logger.Debug("job table reconciled", "scope", scope, "listed", len(jobs), "removed", removed, "total", len(t.jobs))
+}
+
+// snapshot returns the jobs in the scope, and forgets the jobs finished longer than retention ago.
+func (t *jobTable) snapshot(scope jobScope) []jobNode {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var ret []jobNode
+	for id, e := range t.jobs {
+		if (e.job.FinishedAt != time.Time{}) && time.Since(e.job.FinishedAt) > t.retention {
+			delete(t.jobs, id)
+			continue
+		}
+
+		if scope.contains(e.job) {
+			ret = append(ret, e.job)
+		}
+	}
+
+	return ret
+}
+
+// update applies a job event, and tells whether the job is unknown before. A job moving to a status that is never
+// listed is removed, so that it does not count until the next reconciliation.
+func (t *jobTable) update(e *jobEvent) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !listedJobStatus(CiJobStatus(strings.ToUpper(e.BuildStatus))) {
+		delete(t.jobs, e.jobId())
+		return false
+	}
+
+	entry, ok := t.jobs[e.jobId()]
+	if !ok {
+		entry = &jobTableEntry{}
+		t.jobs[e.jobId()] = entry
+	}
+
+	e.apply(&entry.job)
+	entry.updatedAt = time.Now()
+	return !ok
+}
+
+// fill copies the job details not included in job events from a job fetched from the API.
+func (t *jobTable) fill(j jobNode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if e, ok := t.jobs[j.ID]; ok {
+		e.job.Tags = j.Tags
+		e.job.Pipeline = j.Pipeline
+		if (j.QueuedAt != time.Time{}) {
+			e.job.QueuedAt = j.QueuedAt
+		}
+		e.job.Stuck = e.job.Stuck || (j.Stuck && e.job.Status == "PENDING")
+	}
+}
+
+// contains tells whether the job belongs to the scope.
+func (s jobScope) contains(j jobNode) bool {
+	switch {
+	case s.project != "":
+		return j.Project.FullPath == s.project
+	case s.group != "":
+		return strings.HasPrefix(j.Project.FullPath, s.group+"/")
+	default:
+		return true
+	}
+}
+
+// webhookServer receives GitLab job events, and keeps the job table up to date.
+type webhookServer struct {
+	logger hclog.Logger
+	secret string
+	table  *jobTable
+	// fetches the job details that are not included in job events
+	fetchJob func(ctx context.Context, project string, id string) (jobNode, error)
+	address  string
+
+	server *http.Server
+}
+
+func (w *webhookServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Gitlab-Token")), []byte(w.secret)) != 1 {
+		w.logger.Warn("webhook request with invalid secret token rejected", "remote_addr", req.RemoteAddr)
+		http.Error(rw, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if req.Header.Get("X-Gitlab-Event") != webhookEventJob {
+		// other events are not interesting
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	e := &jobEvent{}
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 1<<20)).Decode(e); err != nil {
+		w.logger.Warn("unable to decode job event", "error", err)
+		http.Error(rw, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	if e.ObjectKind != "build" || e.BuildId == 0 {
+		http.Error(rw, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	w.logger.Trace("job event received", "id", e.BuildId, "project", e.Project.PathWithNamespace, "status", e.BuildStatus)
+	if w.table.update(e) {
+		// GitLab responds to webhooks slowly or not at all, so do not let it wait
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), webhookJobFetchTimeout)
+			defer cancel()
+
+			j, err := w.fetchJob(ctx, e.Project.PathWithNamespace, e.jobId())
+			if err != nil {
+				w.logger.Warn("unable to fetch job details", "id", e.BuildId, "error", err)
+				return
+			}
+			w.table.fill(j)
+		}()
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// start listens on the address and serves webhook requests in background.
+func (w *webhookServer) start() error {
+	listener, err := net.Listen("tcp", w.address)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", w.address, err)
+	}
+
+	w.server = &http.Server{
+		Handler:           w,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := w.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			w.logger.Error("webhook server stopped", "error", err)
+		}
+	}()
+
+	w.logger.Info("webhook server started", "address", listener.Addr())
+	return nil
+}
+
+func (w *webhookServer) stop() {
+	if w.server != nil {
+		_ = w.server.Close()
+	}
+}
+
+// fetchJob gets a single job from the API.
+func (g *gitlabInstance) fetchJob(ctx context.Context, project string, id string) (jobNode, error) {
+	q := &queryGetProjectJob{}
+	err := g.query(ctx, "getProjectJob", q, map[string]interface{}{
+		"fullPath": graphql.ID(project),
+		"id":       JobID(id),
+	})
+	if err != nil {
+		return jobNode{}, err
+	}
+	if q.Project == nil {
+		return jobNode{}, notFoundError("project", project)
+	}
+	if q.Project.Job == nil {
+		return jobNode{}, notFoundError("job", id)
+	}
+
+	return *q.Project.Job, nil
+}
@@ -0,0 +1,228 @@
+package gitlab_ci
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	webhookSecret = "webhook-secret"
+)
+
+// webhookTest sends job events to the webhook server of a plugin talking to the fake GitLab.
+type webhookTest struct {
+	t        *testing.T
+	fake     *fakeGitLab
+	plugin   *APMPlugin
+	instance *gitlabInstance
+	server   *httptest.Server
+}
+
+func newWebhookTest(t *testing.T, config map[string]string) *webhookTest {
+	fake := newFakeGitLab(t)
+	c := map[string]string{
+		"webhook_listen": "127.0.0.1:0",
+		"webhook_secret": webhookSecret,
+	}
+	maps.Copy(c, config)
+	plugin := newTestPlugin(t, fake, c)
+	instance := plugin.instances[defaultInstanceName]
+	t.Cleanup(instance.stop)
+
+	server := httptest.NewServer(instance.webhook)
+	t.Cleanup(server.Close)
+
+	return &webhookTest{t: t, fake: fake, plugin: plugin, instance: instance, server: server}
+}
+
+// send posts a job event, and returns the response status code.
+func (w *webhookTest) send(secret string, event map[string]any) int {
+	body, err := json.Marshal(event)
+	require.NoError(w.t, err)
+
+	req, err := http.NewRequest(http.MethodPost, w.server.URL, strings.NewReader(string(body)))
+	require.NoError(w.t, err)
+	req.Header.Set("X-Gitlab-Event", webhookEventJob)
+	req.Header.Set("X-Gitlab-Token", secret)
+
+	resp, err := w.server.Client().Do(req)
+	require.NoError(w.t, err)
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// job returns the job in the table, or nil if there is none.
+func (w *webhookTest) job(id string) *jobNode {
+	for _, j := range w.instance.webhook.table.snapshot(jobScope{}) {
+		if j.ID == id {
+			return &j
+		}
+	}
+	return nil
+}
+
+func jobEventPayload(id int, status string, project string) map[string]any {
+	return map[string]any{
+		"object_kind":      "build",
+		"ref":              "main",
+		"build_id":         id,
+		"build_name":       "build",
+		"build_stage":      "build",
+		"build_status":     status,
+		"build_created_at": time.Now().UTC().Format("2006-01-02 15:04:05 MST"),
+		"project":          map[string]any{"path_with_namespace": project},
+	}
+}
+
+func TestWebhookSecret(t *testing.T) {
+	w := newWebhookTest(t, nil)
+
+	assert.Equal(t, http.StatusUnauthorized, w.send("wrong", jobEventPayload(9, "pending", "group/app")))
+	assert.Equal(t, http.StatusUnauthorized, w.send("", jobEventPayload(9, "pending", "group/app")))
+	assert.Nil(t, w.job("gid://gitlab/Ci::Build/9"))
+	assert.Equal(t, 0, w.fake.requestCount("getProjectJob"))
+}
+
+func TestWebhookEvents(t *testing.T) {
+	w := newWebhookTest(t, nil)
+
+	// an unknown job is stored, and its details are then fetched from the API
+	require.Equal(t, http.StatusNoContent, w.send(webhookSecret, jobEventPayload(9, "pending", "group/app")))
+	j := w.job("gid://gitlab/Ci::Build/9")
+	require.NotNil(t, j)
+	assert.Equal(t, "PENDING", j.Status)
+	assert.Equal(t, "group/app", j.Project.FullPath)
+	require.Eventually(t, func() bool {
+		j := w.job("gid://gitlab/Ci::Build/9")
+		return j != nil && j.Pipeline.Source != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	j = w.job("gid://gitlab/Ci::Build/9")
+	assert.Equal(t, []string{"linux"}, j.Tags)
+	assert.Equal(t, "push", j.Pipeline.Source)
+	assert.Equal(t, "PENDING", j.Status)
+
+	// a known job is updated without fetching it again
+	require.Equal(t, http.StatusNoContent, w.send(webhookSecret, jobEventPayload(9, "running", "group/app")))
+	assert.Equal(t, "RUNNING", w.job("gid://gitlab/Ci::Build/9").Status)
+	assert.Equal(t, []string{"linux"}, w.job("gid://gitlab/Ci::Build/9").Tags)
+	assert.Equal(t, 1, w.fake.requestCount("getProjectJob"))
+
+	// jobs in statuses that are never listed are not stored, and removed if they are known
+	for _, status := range []string{"manual", "scheduled", "skipped"} {
+		require.Equal(t, http.StatusNoContent, w.send(webhookSecret, jobEventPayload(101, status, "group/app")))
+		assert.Nil(t, w.job("gid://gitlab/Ci::Build/101"), status)
+	}
+	require.Equal(t, http.StatusNoContent, w.send(webhookSecret, jobEventPayload(9, "manual", "group/app")))
+	assert.Nil(t, w.job("gid://gitlab/Ci::Build/9"))
+	assert.Equal(t, 1, w.fake.requestCount("getProjectJob"))
+
+	// other events are ignored
+	req, err := http.NewRequest(http.MethodPost, w.server.URL, strings.NewReader("{}"))
+	require.NoError(t, err)
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	req.Header.Set("X-Gitlab-Token", webhookSecret)
+	resp, err := w.server.Client().Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestWebhookReconcile(t *testing.T) {
+	w := newWebhookTest(t, nil)
+
+	// a job the API does not know, e.g. whose finishing event is missed and which is gone since
+	require.Equal(t, http.StatusNoContent, w.send(webhookSecret, jobEventPayload(100, "running", "group/app")))
+	require.NotNil(t, w.job("gid://gitlab/Ci::Build/100"))
+	require.Eventually(t, func() bool {
+		return w.fake.requestCount("getProjectJob") == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the first query reconciles the table with the jobs listed from the API
+	m, err := w.plugin.Query(`metric:"total"`, fixtureRange)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, valueAt(t, m, time.Date(2024, 5, 1, 11, 58, 0, 0, time.UTC)))
+
+	assert.Nil(t, w.job("gid://gitlab/Ci::Build/100"))
+	for _, id := range []string{"4", "5", "6", "8", "9"} {
+		assert.NotNil(t, w.job("gid://gitlab/Ci::Build/"+id), id)
+	}
+
+	// the next queries are answered from the table
+	requests := w.fake.requestCount("getAllJobs")
+	_, err = w.plugin.Query(`metric:"total"`, fixtureRange)
+	require.NoError(t, err)
+	assert.Equal(t, requests, w.fake.requestCount("getAllJobs"))
+}
+
+func TestWebhookConcurrentReconcile(t *testing.T) {
+	// the requests of a single listing
+	w := newWebhookTest(t, nil)
+	_, err := w.plugin.Query(`metric:"total"`, fixtureRange)
+	require.NoError(t, err)
+	listing := w.fake.requestCount("getAllJobs")
+
+	// concurrent queries share the reconciliation
+	w = newWebhookTest(t, nil)
+	w.fake.delay = 50 * time.Millisecond
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := w.plugin.Query(`metric:"total"`, fixtureRange)
+			assert.NoError(t, err)
+			assert.Equal(t, 4.0, valueAt(t, m, time.Date(2024, 5, 1, 11, 58, 0, 0, time.UTC)))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, listing, w.fake.requestCount("getAllJobs"))
+}
+
+func TestWebhookStaleTable(t *testing.T) {
+	w := newWebhookTest(t, map[string]string{
+		"webhook_reconcile_secs": "300",
+		"stale_snapshot_secs":    "60",
+		"retry_max":              "0",
+	})
+	table := w.instance.webhook.table
+	// pretends the last reconciliation is that long ago
+	reconciledAgo := func(d time.Duration) {
+		table.lock.Lock()
+		defer table.lock.Unlock()
+		r := table.reconciled[jobScope{}.String()]
+		r.at = time.Now().Add(-d)
+		table.reconciled[jobScope{}.String()] = r
+	}
+
+	// nothing to serve before the first reconciliation
+	w.fake.fail(fakeFailure{http.StatusInternalServerError, "oops", nil})
+	_, err := w.plugin.Query(`metric:"total"`, fixtureRange)
+	require.Error(t, err)
+
+	_, err = w.plugin.Query(`metric:"total"`, fixtureRange)
+	require.NoError(t, err)
+
+	// the reconciliation is due, but the table is served while it is not older than stale_snapshot_secs past that
+	reconciledAgo(330 * time.Second)
+	w.fake.fail(fakeFailure{http.StatusInternalServerError, "oops", nil})
+	m, err := w.plugin.Query(`metric:"total"`, fixtureRange)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, valueAt(t, m, time.Date(2024, 5, 1, 11, 58, 0, 0, time.UTC)))
+
+	reconciledAgo(370 * time.Second)
+	w.fake.fail(fakeFailure{http.StatusInternalServerError, "oops", nil})
+	_, err = w.plugin.Query(`metric:"total"`, fixtureRange)
+	require.Error(t, err)
+
+	// and recovers once GitLab is back
+	_, err = w.plugin.Query(`metric:"total"`, fixtureRange)
+	require.NoError(t, err)
+}
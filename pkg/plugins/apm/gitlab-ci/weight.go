@@ -0,0 +1,90 @@
+package gitlab_ci
+
+import (
+	"fmt"
+	"github.com/Jamesits/nomad-autoscaler-plugins/pkg/utils"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	weightSelectorTag  = "tag:"
+	weightSelectorName = "name:"
+	// matches every job, as a fallback at the end of the list
+	weightSelectorAny = "*"
+)
+
+// jobWeight is how much capacity the jobs matching a selector need, in an arbitrary unit (e.g. VM-equivalents).
+type jobWeight struct {
+	selector string
+	tags     *utils.Filter
+	name     *utils.Filter
+	weight   float64
+}
+
+// parseWeights parses a comma separated list of `<selector>=<weight>` rules, e.g. `tag:large=1, name:lint-*=0.25, *=0.5`.
+// A selector is either `tag:<term>` matching the job's tags, `name:<pattern>` matching the job name, or `*` matching
+// every job; terms and patterns are in the same format as the job filters.
+func parseWeights(src string) ([]jobWeight, error) {
+	var ret []jobWeight
+
+	for _, rule := range strings.Split(src, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid weight rule %q, must be <selector>=<weight>", rule)
+		}
+
+		w := jobWeight{selector: strings.TrimSpace(rule[:i])}
+		var err error
+		w.weight, err = strconv.ParseFloat(strings.TrimSpace(rule[i+1:]), 64)
+		if err != nil || math.IsNaN(w.weight) || math.IsInf(w.weight, 0) || w.weight < 0 {
+			return nil, fmt.Errorf("invalid weight rule %q, the weight must be a finite non-negative number", rule)
+		}
+
+		switch {
+		case w.selector == weightSelectorAny:
+		case strings.HasPrefix(w.selector, weightSelectorTag):
+			w.tags, err = utils.ParseFilter(strings.TrimPrefix(w.selector, weightSelectorTag))
+		case strings.HasPrefix(w.selector, weightSelectorName):
+			w.name, err = utils.ParseFilter(strings.TrimPrefix(w.selector, weightSelectorName))
+		default:
+			return nil, fmt.Errorf("invalid weight rule %q, the selector must be %s<term>, %s<pattern> or %s", rule, weightSelectorTag, weightSelectorName, weightSelectorAny)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight rule %q: %w", rule, err)
+		}
+
+		ret = append(ret, w)
+	}
+
+	return ret, nil
+}
+
+func (w *jobWeight) match(j jobNode) bool {
+	switch {
+	case w.tags != nil:
+		return w.tags.Match(j.Tags)
+	case w.name != nil:
+		return w.name.Match([]string{j.Name})
+	default:
+		return true
+	}
+}
+
+// weight returns the weight of the first rule matching the job, or 1 if there is none, times the weight of the job's
+// priority class.
+func (q *jobQuery) weight(j jobNode) float64 {
+	for _, w := range q.weights {
+		if w.match(j) {
+			return w.weight * q.priorityWeight(j)
+		}
+	}
+
+	return q.priorityWeight(j)
+}
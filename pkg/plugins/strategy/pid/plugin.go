@@ -5,6 +5,7 @@ import (
 	"github.com/Jamesits/nomad-autoscaler-plugins/pkg/utils"
 	"maps"
 	"math"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +29,21 @@ const (
 	runConfigKeyActionCountMax                    = "output_clamp_max"
 	runConfigKeyActionCountMin                    = "output_clamp_min"
 	runConfigKeyActionCountDeadZone               = "output_dead_zone"
+	runConfigKeyIntegralMax                       = "integral_clamp_max"
+	runConfigKeyIntegralMin                       = "integral_clamp_min"
+	runConfigKeyAntiWindup                        = "anti_windup"
+	runConfigKeyAntiWindupGain                    = "anti_windup_gain"
+
+	configKeyStateStore  = "state_store"
+	configKeyStateDir    = "state_dir"
+	configKeyStateMaxAge = "state_max_age_secs"
+
+	// the integral keeps accumulating regardless of the output
+	antiWindupNone = "none"
+	// the integral stops accumulating while it would push the output further beyond the limits
+	antiWindupConditional = "conditional"
+	// the integral is pulled back by the output's excess beyond the limits
+	antiWindupBackCalculation = "back_calculation"
 )
 
 var (
@@ -47,6 +63,17 @@ var (
 		runConfigKeyActionCountMax:                    "1000.0",
 		runConfigKeyActionCountMin:                    "0.0",
 		runConfigKeyActionCountDeadZone:               "0",
+		runConfigKeyIntegralMax:                       "+Inf",
+		runConfigKeyIntegralMin:                       "-Inf",
+		runConfigKeyAntiWindup:                        antiWindupConditional,
+		runConfigKeyAntiWindupGain:                    "1.0",
+	}
+
+	// plugin-wide config, not part of the policy config
+	defaultAgentConfig = map[string]string{
+		configKeyStateStore:  stateStoreNone,
+		configKeyStateDir:    "",
+		configKeyStateMaxAge: "3600",
 	}
 )
 
@@ -54,6 +81,10 @@ var (
 var _ strategy.Strategy = (*StrategyPlugin)(nil)
 
 type policyState struct {
+	id string
+	// hash of the policy config, see configHash
+	configHash uint64
+
 	// config
 	target                      float64
 	kp                          float64
@@ -65,12 +96,20 @@ type policyState struct {
 	countMax                    float64
 	countMin                    float64
 	countDeadZone               int64
+	integralMax                 float64
+	integralMin                 float64
+	antiWindup                  string
+	antiWindupGain              float64
 
 	// internal states
 	hasPreviousData bool
 	previousTime    time.Time
 	previousError   float64
 	integral        float64
+	// the count the target had, and the count requested, at the previous evaluation producing an output
+	hasPreviousOutput bool
+	previousCount     int64
+	previousOutput    int64
 }
 
 type StrategyPlugin struct {
@@ -78,6 +117,10 @@ type StrategyPlugin struct {
 	logger hclog.Logger
 
 	states map[string]*policyState
+	// nil if the states are not persisted
+	store stateStore
+	// stored states older than this are discarded, 0 to keep them forever
+	stateMaxAge time.Duration
 }
 
 func NewPIDPlugin(log hclog.Logger) strategy.Strategy {
@@ -98,23 +141,54 @@ func (s *StrategyPlugin) SetConfig(config map[string]string) error {
 	// config override
 	s.config = make(map[string]string)
 	maps.Copy(s.config, defaultConfig)
+	maps.Copy(s.config, defaultAgentConfig)
 	maps.Copy(s.config, config)
 
+	maxAge, err := strconv.ParseInt(s.config[configKeyStateMaxAge], 10, 64)
+	if err != nil || maxAge < 0 {
+		return fmt.Errorf("unable to parse %s: must be a non-negative integer, got %q instead", configKeyStateMaxAge, s.config[configKeyStateMaxAge])
+	}
+	s.stateMaxAge = time.Second * time.Duration(maxAge)
+
+	s.store, err = newStateStore(s.config[configKeyStateStore], s.config[configKeyStateDir])
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %w", configKeyStateStore, err)
+	}
+
 	return nil
 }
 
-func (s *StrategyPlugin) newPolicy(id string, config map[string]string) (state *policyState, err error) {
-	if existingState, ok := s.states[id]; ok {
-		return existingState, nil
+// configHash hashes the policy config keys, so that a state is dropped when the config it is built with changes.
+func configHash(c map[string]string) uint64 {
+	keys := make([]string, 0, len(defaultConfig))
+	for k := range defaultConfig {
+		keys = append(keys, k)
 	}
+	slices.Sort(keys)
 
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, c[k])
+	}
+	return utils.FNV64a(b.String())
+}
+
+func (s *StrategyPlugin) newPolicy(id string, config map[string]string) (state *policyState, err error) {
 	// config override
 	c := make(map[string]string)
 	maps.Copy(c, s.config)
 	maps.Copy(c, config)
+	hash := configHash(c)
+
+	if existingState, ok := s.states[id]; ok {
+		if existingState.configHash == hash {
+			return existingState, nil
+		}
+		s.logger.Info("policy config changed, resetting policy state", "id", id)
+	}
 
 	s.logger.Debug("creating new policy state", "id", id, "config", c)
-	state = &policyState{}
+	state = &policyState{id: id, configHash: hash}
 
 	// parse args
 	state.target, err = strconv.ParseFloat(c[runConfigKeyTarget], 64)
@@ -176,10 +250,176 @@ func (s *StrategyPlugin) newPolicy(id string, config map[string]string) (state *
 		return nil, fmt.Errorf("unable to parse %s: %w", runConfigKeyActionCountDeadZone, err)
 	}
 
+	state.integralMax, err = strconv.ParseFloat(c[runConfigKeyIntegralMax], 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", runConfigKeyIntegralMax, err)
+	}
+	if math.IsNaN(state.integralMax) {
+		return nil, fmt.Errorf("%s cannot be NaN", runConfigKeyIntegralMax)
+	}
+
+	state.integralMin, err = strconv.ParseFloat(c[runConfigKeyIntegralMin], 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", runConfigKeyIntegralMin, err)
+	}
+	if math.IsNaN(state.integralMin) {
+		return nil, fmt.Errorf("%s cannot be NaN", runConfigKeyIntegralMin)
+	}
+
+	if state.integralMax < state.integralMin {
+		return nil, fmt.Errorf("conflict: %s cannot be smaller than %s", runConfigKeyIntegralMax, runConfigKeyIntegralMin)
+	}
+
+	state.antiWindup = strings.ToLower(strings.TrimSpace(c[runConfigKeyAntiWindup]))
+	if !utils.MatchAny([]string{state.antiWindup}, []string{antiWindupNone, antiWindupConditional, antiWindupBackCalculation}) {
+		return nil, fmt.Errorf("unable to parse %s: unknown method %q", runConfigKeyAntiWindup, state.antiWindup)
+	}
+
+	state.antiWindupGain, err = strconv.ParseFloat(c[runConfigKeyAntiWindupGain], 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", runConfigKeyAntiWindupGain, err)
+	}
+	if math.IsNaN(state.antiWindupGain) || math.IsInf(state.antiWindupGain, 0) || state.antiWindupGain < 0 {
+		return nil, fmt.Errorf("%s must be a finite non-negative number", runConfigKeyAntiWindupGain)
+	}
+
+	s.restore(state)
 	s.states[id] = state
 	return state, nil
 }
 
+// restore loads the internal states of a new policy state from the store, unless they are built with another config.
+func (s *StrategyPlugin) restore(state *policyState) {
+	if s.store == nil {
+		return
+	}
+
+	stored, err := s.store.load(state.id)
+	if err != nil {
+		s.logger.Warn("unable to load policy state", "id", state.id, "error", err)
+		return
+	}
+
+	switch {
+	case stored == nil:
+		return
+	case stored.Version != storedStateVersion:
+		s.logger.Info("discarding stored policy state of another version", "id", state.id, "version", stored.Version)
+	case stored.ConfigHash != state.configHash:
+		s.logger.Info("policy config changed, discarding stored policy state", "id", state.id)
+	case s.stateMaxAge > 0 && time.Since(stored.SavedAt) > s.stateMaxAge:
+		s.logger.Info("discarding outdated policy state", "id", state.id, "saved_at", stored.SavedAt)
+	default:
+		state.hasPreviousData = stored.HasPreviousData
+		state.previousTime = stored.PreviousTime
+		state.previousError = stored.PreviousError
+		state.integral = stored.Integral
+		state.hasPreviousOutput = stored.HasPreviousOutput
+		state.previousCount = stored.PreviousCount
+		state.previousOutput = stored.PreviousOutput
+		s.logger.Info("policy state restored", "id", state.id, "saved_at", stored.SavedAt)
+	}
+}
+
+// persist saves the internal states of a policy state to the store. Failures are only logged, since the policy can
+// still be evaluated without them.
+func (s *StrategyPlugin) persist(state *policyState) {
+	if s.store == nil {
+		return
+	}
+
+	err := s.store.save(&storedState{
+		Version:           storedStateVersion,
+		ID:                state.id,
+		ConfigHash:        state.configHash,
+		SavedAt:           time.Now(),
+		HasPreviousData:   state.hasPreviousData,
+		PreviousTime:      state.previousTime,
+		PreviousError:     state.previousError,
+		Integral:          state.integral,
+		HasPreviousOutput: state.hasPreviousOutput,
+		PreviousCount:     state.previousCount,
+		PreviousOutput:    state.previousOutput,
+	})
+	if err != nil {
+		s.logger.Warn("unable to save policy state", "id", state.id, "error", err)
+	}
+}
+
+// pid returns the PID output with the integral.
+func (state *policyState) pid(proportional float64, integral float64, derivative float64) float64 {
+	return state.kp*proportional + state.ki*integral + state.kd*derivative
+}
+
+// transform applies the output polynomial.
+func (state *policyState) transform(rawOutput float64) float64 {
+	var ret float64
+	for p, k := range state.countPolynomialCoefficients {
+		ret += k * math.Pow(rawOutput, float64(p))
+	}
+	return ret
+}
+
+// transformSlope returns the derivative of the output polynomial.
+func (state *policyState) transformSlope(rawOutput float64) float64 {
+	var ret float64
+	for p, k := range state.countPolynomialCoefficients {
+		if p > 0 {
+			ret += float64(p) * k * math.Pow(rawOutput, float64(p-1))
+		}
+	}
+	return ret
+}
+
+// outputLimits returns the limits of the transformed output. Besides the clamp limits, if the target has not followed
+// the previous scaling request (it refuses to, or it is still in progress), its current count is the limit in that
+// direction.
+func (state *policyState) outputLimits(count int64) (lower float64, upper float64) {
+	lower, upper = state.countMin, state.countMax
+
+	if state.hasPreviousOutput && count == state.previousCount {
+		if state.previousOutput > count {
+			upper = math.Min(upper, float64(count))
+		} else if state.previousOutput < count {
+			lower = math.Max(lower, float64(count))
+		}
+	}
+
+	return lower, upper
+}
+
+// updateIntegral returns the integral for this evaluation, with anti-windup applied.
+func (state *policyState) updateIntegral(proportional float64, derivative float64, dt float64, count int64) float64 {
+	clamp := func(integral float64) float64 {
+		return math.Max(math.Min(integral, state.integralMax), state.integralMin)
+	}
+
+	integral := clamp(state.integral + proportional*dt)
+	lower, upper := state.outputLimits(count)
+
+	switch state.antiWindup {
+	case antiWindupConditional:
+		// stop integrating while the output is saturated and integrating would drive it further into saturation
+		previous := state.transform(state.pid(proportional, state.integral, derivative))
+		output := state.transform(state.pid(proportional, integral, derivative))
+		if (previous >= upper && output > previous) || (previous <= lower && output < previous) {
+			return state.integral
+		}
+
+	case antiWindupBackCalculation:
+		// unwind the integral by the output's excess, mapped back to the PID output by the polynomial's local slope
+		rawOutput := state.pid(proportional, integral, derivative)
+		output := state.transform(rawOutput)
+		excess := math.Max(math.Min(output, upper), lower) - output
+		slope := state.transformSlope(rawOutput)
+		if excess != 0 && state.ki != 0 && slope != 0 {
+			integral = clamp(integral + math.Min(1, state.antiWindupGain*dt)*excess/slope/state.ki)
+		}
+	}
+
+	return integral
+}
+
 func (s *StrategyPlugin) Run(eval *sdk.ScalingCheckEvaluation, count int64) (*sdk.ScalingCheckEvaluation, error) {
 	// we cannot get any per-policy unique ID, so we try our best to create one
 	id := fmt.Sprintf("%s/%d/%s/%s/%s", eval.Check.Source, utils.FNV64a(eval.Check.Query), eval.Check.Group, eval.Check.Name, eval.Check.Strategy.Name)
@@ -206,34 +446,37 @@ func (s *StrategyPlugin) Run(eval *sdk.ScalingCheckEvaluation, count int64) (*sd
 	// Use only the latest value for now.
 	measured := eval.Metrics[len(eval.Metrics)-1]
 
+	// ignore the first sample; there is no time interval to integrate over yet
+	proportional := state.target - measured.Value
+	if !state.hasPreviousData {
+		s.logger.Info("first time here, not generating policies")
+		state.previousError = proportional
+		state.previousTime = measured.Timestamp
+		state.hasPreviousData = true
+		s.persist(state)
+		return eval, nil
+	}
+
 	// PID
 	dt := float64(measured.Timestamp.Sub(state.previousTime) / state.timeDivider)
-	proportional := state.target - measured.Value
-	integral := state.integral + proportional*dt
 	derivative := (proportional - state.previousError) / dt
-	rawOutput := state.kp*proportional + state.ki*integral + state.kd*derivative
+	integral := state.updateIntegral(proportional, derivative, dt, count)
+	rawOutput := state.pid(proportional, integral, derivative)
 	if math.IsNaN(rawOutput) {
 		s.logger.Warn("rawOutput capped to 0 from NaN", "p", proportional, "i", integral, "d", derivative)
 		rawOutput = 0
 	}
 
 	// save internal state
-	state.integral = integral
+	if !math.IsNaN(integral) {
+		state.integral = integral
+	}
 	state.previousError = proportional
 	state.previousTime = measured.Timestamp
-	// ignore the first sample
-	if !state.hasPreviousData {
-		s.logger.Info("first time here, not generating policies")
-		state.hasPreviousData = true
-		return eval, nil
-	}
 
 	// output transformation
-	var tOutput float64
 	// polynomial
-	for p, k := range state.countPolynomialCoefficients {
-		tOutput += k * math.Pow(rawOutput, float64(p))
-	}
+	tOutput := state.transform(rawOutput)
 	// clamping
 	tOutput = math.Min(tOutput, state.countMax)
 	tOutput = math.Max(tOutput, state.countMin)
@@ -257,6 +500,10 @@ func (s *StrategyPlugin) Run(eval *sdk.ScalingCheckEvaluation, count int64) (*sd
 	}
 
 	eval.Action.Count = tOutputInt
+	state.hasPreviousOutput = true
+	state.previousCount = count
+	state.previousOutput = tOutputInt
+	s.persist(state)
 	eval.Action.Reason = fmt.Sprintf("PID output: %f", rawOutput)
 	if tOutputInt == count {
 		eval.Action.Direction = sdk.ScaleDirectionNone
@@ -272,6 +519,7 @@ func (s *StrategyPlugin) Run(eval *sdk.ScalingCheckEvaluation, count int64) (*sd
 		"metric_value", measured.Value,
 		"current_count", count,
 		"raw_output", rawOutput,
+		"integral", integral,
 		"new_count", tOutputInt,
 		"direction", eval.Action.Direction,
 	)
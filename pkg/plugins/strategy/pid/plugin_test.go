@@ -0,0 +1,215 @@
+package pid
+
+import (
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	// a pure integral controller; the metric is 0 while loaded and 20 after the load drops
+	integralConfig = map[string]string{
+		runConfigKeyTarget:         "10",
+		runConfigKeyKp:             "0",
+		runConfigKeyKi:             "1",
+		runConfigKeyActionCountMax: "5",
+	}
+	startTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+)
+
+// run evaluates the policy with a metric sampled every second, and returns the requested count.
+func run(t *testing.T, s *StrategyPlugin, config map[string]string, second int, value float64, count int64) int64 {
+	eval := &sdk.ScalingCheckEvaluation{
+		Check: &sdk.ScalingPolicyCheck{
+			Name:     "test",
+			Strategy: &sdk.ScalingPolicyStrategy{Name: "pid", Config: config},
+		},
+		Metrics: sdk.TimestampedMetrics{{Timestamp: startTime.Add(time.Duration(second) * time.Second), Value: value}},
+		Action:  &sdk.ScalingAction{},
+	}
+
+	eval, err := s.Run(eval, count)
+	require.NoError(t, err)
+	return eval.Action.Count
+}
+
+func newTestPlugin(t *testing.T) *StrategyPlugin {
+	return newTestPluginWithConfig(t, map[string]string{})
+}
+
+func newTestPluginWithConfig(t *testing.T, config map[string]string) *StrategyPlugin {
+	s := NewPIDPlugin(hclog.NewNullLogger()).(*StrategyPlugin)
+	require.NoError(t, s.SetConfig(config))
+	return s
+}
+
+func TestAntiWindup(t *testing.T) {
+	cases := []struct {
+		name   string
+		config map[string]string
+		// the integral after 4 evaluations under load
+		wantIntegral float64
+		// the count requested right after the load drops
+		wantCount int64
+	}{
+		{"none", map[string]string{runConfigKeyAntiWindup: antiWindupNone}, 40, 5},
+		{"conditional", map[string]string{}, 10, 0},
+		{"back calculation", map[string]string{runConfigKeyAntiWindup: antiWindupBackCalculation}, 5, 0},
+		{"integral clamp", map[string]string{runConfigKeyAntiWindup: antiWindupNone, runConfigKeyIntegralMax: "15"}, 15, 5},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := maps.Clone(integralConfig)
+			maps.Copy(config, c.config)
+			s := newTestPlugin(t)
+
+			count := int64(0)
+			for i := 0; i <= 4; i++ {
+				count = run(t, s, config, i, 0, count)
+			}
+			assert.Equal(t, int64(5), count)
+			for _, state := range s.states {
+				assert.Equal(t, c.wantIntegral, state.integral)
+			}
+
+			assert.Equal(t, c.wantCount, run(t, s, config, 5, 20, count))
+		})
+	}
+}
+
+func TestAntiWindupTargetStalled(t *testing.T) {
+	config := maps.Clone(integralConfig)
+	config[runConfigKeyActionCountMax] = "1000"
+	s := newTestPlugin(t)
+
+	// the target never scales
+	run(t, s, config, 0, 0, 0)
+	assert.Equal(t, int64(10), run(t, s, config, 1, 0, 0))
+	assert.Equal(t, int64(10), run(t, s, config, 2, 0, 0))
+	assert.Equal(t, int64(10), run(t, s, config, 3, 0, 0))
+
+	// the load drops, and the target is scaled down right away
+	assert.Equal(t, int64(0), run(t, s, config, 4, 20, 0))
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		config map[string]string
+	}{
+		{"invalid integral clamp", map[string]string{runConfigKeyIntegralMax: "big"}},
+		{"integral clamp conflict", map[string]string{runConfigKeyIntegralMax: "-1", runConfigKeyIntegralMin: "1"}},
+		{"invalid anti-windup method", map[string]string{runConfigKeyAntiWindup: "clamp"}},
+		{"NaN integral clamp max", map[string]string{runConfigKeyIntegralMax: "NaN"}},
+		{"NaN integral clamp min", map[string]string{runConfigKeyIntegralMin: "NaN"}},
+		{"negative anti-windup gain", map[string]string{runConfigKeyAntiWindupGain: "-1"}},
+		{"NaN anti-windup gain", map[string]string{runConfigKeyAntiWindupGain: "NaN"}},
+		{"infinite anti-windup gain", map[string]string{runConfigKeyAntiWindupGain: "Inf"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestPlugin(t)
+			_, err := s.newPolicy("test", c.config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	agentConfig := map[string]string{configKeyStateStore: stateStoreFile, configKeyStateDir: filepath.Join(t.TempDir(), "state")}
+	config := maps.Clone(integralConfig)
+	config[runConfigKeyActionCountMax] = "1000"
+
+	s := newTestPluginWithConfig(t, agentConfig)
+	run(t, s, config, 0, 8, 0)
+	assert.Equal(t, int64(2), run(t, s, config, 1, 8, 0))
+
+	// only the state files are left
+	files, err := os.ReadDir(agentConfig[configKeyStateDir])
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, ".json", filepath.Ext(files[0].Name()))
+
+	// restarted; the first evaluation is not skipped, and the integral goes on
+	s = newTestPluginWithConfig(t, agentConfig)
+	assert.Equal(t, int64(4), run(t, s, config, 2, 8, 2))
+
+	// the policy config is changed
+	config[runConfigKeyKi] = "2"
+	s = newTestPluginWithConfig(t, agentConfig)
+	assert.Equal(t, int64(0), run(t, s, config, 3, 8, 4))
+	assert.Equal(t, int64(4), run(t, s, config, 4, 8, 4))
+
+	// the policy config is changed without restarting
+	config[runConfigKeyKi] = "1"
+	assert.Equal(t, int64(0), run(t, s, config, 5, 8, 4))
+
+	// the state is too old
+	require.Len(t, s.states, 1)
+	for id := range s.states {
+		stored, err := s.store.load(id)
+		require.NoError(t, err)
+		require.NotNil(t, stored)
+		stored.SavedAt = time.Now().Add(-2 * time.Minute)
+		require.NoError(t, s.store.save(stored))
+	}
+	agentConfig[configKeyStateMaxAge] = "60"
+	s = newTestPluginWithConfig(t, agentConfig)
+	assert.Equal(t, int64(0), run(t, s, config, 6, 8, 4))
+}
+
+func TestStateStoreVersion(t *testing.T) {
+	store, err := newFileStateStore(t.TempDir())
+	require.NoError(t, err)
+	s := newTestPlugin(t)
+	s.store = store
+
+	state, err := s.newPolicy("test", integralConfig)
+	require.NoError(t, err)
+	state.integral = 42
+	s.persist(state)
+
+	stored, err := store.load("test")
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, 42.0, stored.Integral)
+	stored.Version = storedStateVersion + 1
+	require.NoError(t, store.save(stored))
+
+	// another version is discarded
+	s.states = make(map[string]*policyState)
+	state, err = s.newPolicy("test", integralConfig)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, state.integral)
+
+	// nothing is stored for the other policies
+	missing, err := store.load("other")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestSetConfigErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		config map[string]string
+	}{
+		{"unknown state store", map[string]string{configKeyStateStore: "consul"}},
+		{"file store without directory", map[string]string{configKeyStateStore: stateStoreFile}},
+		{"invalid state max age", map[string]string{configKeyStateMaxAge: "-1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewPIDPlugin(hclog.NewNullLogger()).(*StrategyPlugin)
+			assert.Error(t, s.SetConfig(c.config))
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package pid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jamesits/nomad-autoscaler-plugins/pkg/utils"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// bumped whenever the stored state changes incompatibly; states of other versions are discarded
+	storedStateVersion = 1
+
+	// no persistence
+	stateStoreNone = "none"
+	// one JSON file per policy in state_dir
+	stateStoreFile = "file"
+)
+
+// storedState is the part of a policy state that survives plugin restarts.
+type storedState struct {
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	// the state is only valid for the policy config it is built with
+	ConfigHash uint64    `json:"config_hash"`
+	SavedAt    time.Time `json:"saved_at"`
+
+	HasPreviousData   bool      `json:"has_previous_data"`
+	PreviousTime      time.Time `json:"previous_time"`
+	PreviousError     float64   `json:"previous_error"`
+	Integral          float64   `json:"integral"`
+	HasPreviousOutput bool      `json:"has_previous_output"`
+	PreviousCount     int64     `json:"previous_count"`
+	PreviousOutput    int64     `json:"previous_output"`
+}
+
+// stateStore persists policy states.
+type stateStore interface {
+	// load returns the stored state of the policy, or nil if there is none.
+	load(id string) (*storedState, error)
+	save(state *storedState) error
+}
+
+func newStateStore(kind string, dir string) (stateStore, error) {
+	switch kind {
+	case stateStoreNone:
+		return nil, nil
+	case stateStoreFile:
+		return newFileStateStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown state store %q", kind)
+	}
+}
+
+// fileStateStore keeps every policy state in its own file, replaced atomically on every save so that a crash never
+// leaves a partially written state behind.
+type fileStateStore struct {
+	dir string
+}
+
+func newFileStateStore(dir string) (*fileStateStore, error) {
+	if dir == "" {
+		return nil, errors.New("the state directory is not set")
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create state directory %s: %w", dir, err)
+	}
+
+	return &fileStateStore{dir: dir}, nil
+}
+
+// path returns the file of a policy; the IDs contain arbitrary characters, so they are hashed.
+func (f *fileStateStore) path(id string) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%016x.json", utils.FNV64a(id)))
+}
+
+func (f *fileStateStore) load(id string) (*storedState, error) {
+	content, err := os.ReadFile(f.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ret storedState
+	if err := json.Unmarshal(content, &ret); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", f.path(id), err)
+	}
+
+	// hash collision
+	if ret.ID != id {
+		return nil, nil
+	}
+
+	return &ret, nil
+}
+
+func (f *fileStateStore) save(state *storedState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".state-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op after a successful rename
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path(state.ID))
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter is a list of inclusion and exclusion terms parsed from a comma separated list, e.g. `a, b+c, -d`.
+//
+// A term is one or more patterns joined by `+`, and matches a set of values only if every one of its patterns matches
+// at least one of the values. A pattern is either a regular expression between slashes (`/^gpu-.*$/`, a `/` inside it
+// must be escaped as `\/`), or a glob where `*` matches anything except `/`, `**` matches anything, and `?` matches a
+// single character except `/`.
+//
+// A set of values passes the filter if it does not match any exclusion term, and matches at least one of the inclusion
+// terms if there are any.
+type Filter struct {
+	Include []FilterTerm
+	Exclude []FilterTerm
+}
+
+type FilterTerm []*regexp.Regexp
+
+func ParseFilter(src string) (*Filter, error) {
+	f := &Filter{}
+
+	for _, t := range splitOutsideRegexp(src, ',') {
+		term := strings.TrimSpace(t)
+		if term == "" {
+			continue
+		}
+
+		exclude := strings.HasPrefix(term, "-")
+		if exclude {
+			term = term[1:]
+		}
+
+		var parsed FilterTerm
+		for _, p := range splitOutsideRegexp(term, '+') {
+			r, err := compilePattern(strings.TrimSpace(p))
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+			parsed = append(parsed, r)
+		}
+
+		if exclude {
+			f.Exclude = append(f.Exclude, parsed)
+		} else {
+			f.Include = append(f.Include, parsed)
+		}
+	}
+
+	return f, nil
+}
+
+// Merge returns a filter with the terms of both filters.
+func (f *Filter) Merge(other *Filter) *Filter {
+	ret := &Filter{}
+	ret.Include = append(append(ret.Include, f.Include...), other.Include...)
+	ret.Exclude = append(append(ret.Exclude, f.Exclude...), other.Exclude...)
+	return ret
+}
+
+func (f *Filter) Match(values []string) bool {
+	for _, t := range f.Exclude {
+		if t.match(values) {
+			return false
+		}
+	}
+
+	if len(f.Include) == 0 {
+		return true
+	}
+
+	for _, t := range f.Include {
+		if t.match(values) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns the filter in its source format, for logging.
+func (f *Filter) String() string {
+	var terms []string
+	for _, t := range f.Include {
+		terms = append(terms, t.String())
+	}
+	for _, t := range f.Exclude {
+		terms = append(terms, "-"+t.String())
+	}
+	return strings.Join(terms, ",")
+}
+
+func (t FilterTerm) match(values []string) bool {
+	for _, r := range t {
+		matched := false
+		for _, v := range values {
+			if r.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t FilterTerm) String() string {
+	var patterns []string
+	for _, r := range t {
+		patterns = append(patterns, r.String())
+	}
+	return strings.Join(patterns, "+")
+}
+
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if p == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	if len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		return regexp.Compile(p[1 : len(p)-1])
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(p); i++ {
+		switch {
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case p[i] == '*':
+			b.WriteString("[^/]*")
+		case p[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
+
+// splitOutsideRegexp splits src by sep, except for the separators inside regular expressions between slashes.
+func splitOutsideRegexp(src string, sep byte) []string {
+	var ret []string
+	start := 0
+	inRegexp := false
+
+	for i := 0; i < len(src); i++ {
+		switch {
+		case inRegexp && src[i] == '\\':
+			// skip the escaped character
+			i++
+		case src[i] == '/':
+			if inRegexp {
+				inRegexp = false
+			} else if strings.TrimLeft(src[start:i], " -") == "" {
+				// a slash at the start of a pattern
+				inRegexp = true
+			}
+		case !inRegexp && src[i] == sep:
+			ret = append(ret, src[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(ret, src[start:])
+}